@@ -0,0 +1,835 @@
+// Package chatclient is a Go SDK for the websocket chat server. It owns the
+// join and key exchange handshakes so that programs such as bots and the
+// terminal UI only deal with plain text messages.
+package chatclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"websocket-chat/comm"
+	"websocket-chat/util"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrClosed    = errors.New("chatclient: client closed")
+	ErrQueueFull = errors.New("chatclient: too many messages waiting for the connection to come back")
+	// The server did not accept our password, or our login token
+	ErrUnauthorized = errors.New("chatclient: wrong username or password")
+	// An operator removed us from the room
+	ErrKicked = errors.New("chatclient: kicked from the room")
+	// The connection failed before a message could be written
+	errNotSent = errors.New("chatclient: connection lost before the message was sent")
+)
+
+// UsernameRejected reports whether err means the server would not let us in
+// under our username, because someone in the room already uses it, because
+// it is reserved or because it is not a valid name. The user should pick
+// another one.
+func UsernameRejected(err error) bool {
+	var rejection *comm.Error
+	if !errors.As(err, &rejection) {
+		return false
+	}
+	switch rejection.Code {
+	case comm.ErrCodeUsernameTaken, comm.ErrCodeUsernameReserved, comm.ErrCodeUsernameInvalid:
+		return true
+	}
+	return false
+}
+
+// Banned reports whether err means we are banned from the room. The client
+// does not try to join again by itself.
+func Banned(err error) bool {
+	var rejection *comm.Error
+	return errors.As(err, &rejection) && rejection.Code == comm.ErrCodeBanned
+}
+
+// RateLimited reports whether err means the server dropped one of our
+// messages because we send too fast, or were muted for it. It comes with an
+// Error event.
+func RateLimited(err error) bool {
+	var rejection *comm.Error
+	if !errors.As(err, &rejection) {
+		return false
+	}
+	return rejection.Code == comm.ErrCodeRateLimited || rejection.Code == comm.ErrCodeMuted
+}
+
+// Messages sent while the connection is down are kept until it is back, up to
+// this many
+const maxQueuedMessages = 100
+
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	// Room to join. Defaults to comm.DefaultRoom.
+	Room string
+	// Dialer used for every connection to the server. Defaults to
+	// websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	// Long-term identity key that signs our key exchanges. Defaults to a
+	// fresh identity, which peers will see as a new, unverified key on every
+	// run; use util.LoadOrCreateIdentity to keep one on disk.
+	Identity *util.Identity
+	// Where peers' identity keys are remembered. Defaults to an in-memory
+	// store.
+	TrustStore *TrustStore
+	// By default the client reconnects whenever the connection is lost.
+	// Set this to end the client at the first disconnect instead.
+	DisableReconnect bool
+	// Password to log in with, on servers that require accounts. The client
+	// logs in again by itself whenever its token expires.
+	Password string
+	// If set, the client connects with TLS (wss and https) using this
+	// config. See NewTLSConfig.
+	TLS *tls.Config
+	// How often the server is pinged, and how long it has to answer before
+	// the connection is taken for dead and the client reconnects. Default to
+	// util.DefaultPingInterval and util.DefaultPongTimeout.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+}
+
+type Client struct {
+	cfg  Config
+	keys util.Keys
+	// Sent with every join so the server can resume our membership after a
+	// reconnect
+	session string
+	// Login token for /ws, if we logged in. Only used while connecting.
+	token      *comm.LoginResult
+	httpClient *http.Client
+
+	// The current connection. It is only replaced by the run loop, while no
+	// read loop is running.
+	current *connection
+	connMu  sync.Mutex
+
+	// Whether we are a member of the room right now, and what the user sent
+	// while we were not
+	connected bool
+	queued    []queuedText
+	stateMu   sync.Mutex
+
+	// Key exchanges in progress, by exchange id. Only used by the read loop.
+	exchanges map[string]*keyExchange
+	// Requests waiting for their reply, by request id
+	requests   map[string]chan comm.Message
+	requestsMu sync.Mutex
+
+	// Our own sender chain and the chains other members announced
+	myChain      *util.SenderChain
+	myChainEpoch uint64
+	myChainId    string
+	chains       map[chainId]*util.SenderChain
+	pending      []comm.Message
+	chainsMu     sync.Mutex
+
+	// Identity keys seen for each username during this session
+	peers   map[string][]byte
+	peersMu sync.Mutex
+
+	outgoing     chan frame
+	events       chan Event
+	eventsClosed bool
+	eventsMu     sync.RWMutex
+	done         chan struct{}
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// A connection is one websocket session with the server. The client starts a
+// new one every time it reconnects.
+type connection struct {
+	conn *websocket.Conn
+	// Protocol version the server picked when we joined
+	version int
+	// The server resumed our session, so we kept our room key
+	resumed bool
+	// Closed once we have a room key and are a member of the room
+	ready chan struct{}
+	// Closed when the read loop for this connection has ended
+	closed chan struct{}
+	// Set by the read loop if an operator removed us from the room
+	kicked *comm.Kicked
+}
+
+// A queuedText waits for the connection to come back. To is set for private
+// messages.
+type queuedText struct {
+	to   string
+	text string
+}
+
+// A frame is a message waiting to be sent, along with its correlation id.
+// The write loop reports how writing it went on result.
+type frame struct {
+	id     string
+	msg    comm.Message
+	result chan error
+}
+
+// Dial joins the configured room and returns once the client is ready to
+// send and receive chat messages. The join, the key exchange and the chat
+// all run over a single websocket connection. If that connection is lost
+// later on, the client reconnects by itself.
+func Dial(ctx context.Context, cfg Config) (*Client, error) {
+	// The server turns away names with spaces around them
+	cfg.Username = strings.TrimSpace(cfg.Username)
+	if cfg.Username == "" {
+		return nil, errors.New("chatclient: username is required")
+	}
+	if cfg.Room == "" {
+		cfg.Room = comm.DefaultRoom
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = websocket.DefaultDialer
+	}
+	// Work on a copy, since the dialer may be shared
+	dialer := *cfg.Dialer
+	if len(dialer.Subprotocols) == 0 {
+		dialer.Subprotocols = []string{comm.Subprotocol}
+	}
+	cfg.Dialer = &dialer
+	httpClient := http.DefaultClient
+	if cfg.TLS != nil {
+		dialer.TLSClientConfig = cfg.TLS
+		httpClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: cfg.TLS}}
+	}
+	if cfg.Identity == nil {
+		identity, err := util.GenerateIdentity()
+		if err != nil {
+			return nil, errors.New("Error generating identity: " + err.Error())
+		}
+		cfg.Identity = identity
+	}
+	if cfg.TrustStore == nil {
+		cfg.TrustStore, _ = LoadTrustStore("")
+	}
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = util.DefaultPingInterval
+	}
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = util.DefaultPongTimeout
+	}
+
+	c := &Client{
+		cfg:        cfg,
+		session:    uuid.New().String(),
+		httpClient: httpClient,
+		exchanges:  make(map[string]*keyExchange),
+		requests:   make(map[string]chan comm.Message),
+		peers:      make(map[string][]byte),
+		chains:     make(map[chainId]*util.SenderChain),
+		outgoing:   make(chan frame),
+		events:     make(chan Event, 64),
+		done:       make(chan struct{}),
+		closing:    make(chan struct{}),
+	}
+
+	cn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.run(cn)
+	go c.writeLoop()
+
+	err = c.finishJoin(ctx, cn)
+	if err != nil {
+		c.Close()
+		return nil, errors.New("Error joining chat: " + err.Error())
+	}
+	return c, nil
+}
+
+// connect dials the server and joins the room
+func (c *Client) connect(ctx context.Context) (*connection, error) {
+	conn, err := c.dial(ctx, "/ws")
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &connection{conn: conn, version: comm.ProtocolVersion, ready: make(chan struct{}), closed: make(chan struct{})}
+	util.Heartbeat(conn, c.cfg.PingInterval, c.cfg.PongTimeout, cn.closed)
+	err = c.join(cn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error joining chat: %w", err)
+	}
+	if cn.resumed {
+		close(cn.ready)
+	}
+
+	c.connMu.Lock()
+	c.current = cn
+	c.connMu.Unlock()
+	c.exchanges = make(map[string]*keyExchange)
+	return cn, nil
+}
+
+// finishJoin waits until we are a member of the room, then introduces us to
+// the other members and sends what the user wrote while we were offline
+func (c *Client) finishJoin(ctx context.Context, cn *connection) error {
+	// Unless we are the key hub or resumed our session, the key hub now
+	// hands us the room key
+	select {
+	case <-cn.ready:
+	case <-cn.closed:
+		return errors.New("disconnected before receiving the room key")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Announce our identity key to the rest of the room
+	err := c.write(&comm.Identity{Username: c.cfg.Username, SignedKey: c.cfg.Identity.Sign(c.cfg.Username, nil)})
+	if err != nil {
+		return errors.New("Error announcing identity: " + err.Error())
+	}
+
+	// Hand our sender chain to the room and ask for everyone else's. Members
+	// who joined while we were away do not have it yet.
+	err = c.announceSenderKey(true)
+	if err != nil {
+		return err
+	}
+
+	c.flushQueue()
+	return nil
+}
+
+// Messages returns the stream of events from the server. The channel is
+// closed once the client is closed or the connection is lost for good.
+func (c *Client) Messages() <-chan Event {
+	return c.events
+}
+
+// Connected reports whether the client is currently a member of the room.
+// While it is not, Send queues messages until the connection is back.
+func (c *Client) Connected() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.connected
+}
+
+// Epoch returns the room key epoch we are on. It goes up every time the room
+// key is rotated.
+func (c *Client) Epoch() uint64 {
+	epoch, _ := c.keys.GetRoomKey()
+	return epoch
+}
+
+// Send encrypts text with the next key from our sender chain and sends it to
+// the room. If the connection is down, text is sent once it is back.
+func (c *Client) Send(text string) error {
+	return c.queueText(queuedText{text: text})
+}
+
+// SendTo sends text to username alone. The server does not pass it on to the
+// other members of the room or keep it in the history. It is encrypted like
+// any other message though, so it is hidden from them by the server, not by
+// the encryption.
+func (c *Client) SendTo(username string, text string) error {
+	if username == "" {
+		return errors.New("chatclient: username is required")
+	}
+	return c.queueText(queuedText{to: username, text: text})
+}
+
+func (c *Client) queueText(text queuedText) error {
+	c.stateMu.Lock()
+	if !c.connected {
+		defer c.stateMu.Unlock()
+		if len(c.queued) >= maxQueuedMessages {
+			return ErrQueueFull
+		}
+		c.queued = append(c.queued, text)
+		return nil
+	}
+	c.stateMu.Unlock()
+	err := c.sendText(text)
+	if !errors.Is(err, errNotSent) {
+		return err
+	}
+
+	// The connection failed under us. Queue this and whatever comes next
+	// until the run loop has reconnected.
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.connected = false
+	if len(c.queued) >= maxQueuedMessages {
+		return ErrQueueFull
+	}
+	c.queued = append(c.queued, text)
+	return nil
+}
+
+// sendText encrypts text and sends it. If the connection fails before it is
+// written, the error wraps errNotSent.
+func (c *Client) sendText(text queuedText) error {
+	epoch, index, messageKey, err := c.nextMessageKey()
+	if err != nil {
+		return errors.New("Error encrypting message: " + err.Error())
+	}
+
+	msg := &comm.Text{Username: c.cfg.Username, Seq: index, Epoch: epoch, To: text.to}
+	err = msg.Encrypt([]byte(text.text), messageKey)
+	if err != nil {
+		return errors.New("Error encrypting message: " + err.Error())
+	}
+
+	err = c.write(msg)
+	if err != nil && !errors.Is(err, ErrClosed) {
+		return fmt.Errorf("%w: %w", errNotSent, err)
+	}
+	return err
+}
+
+// flushQueue sends the messages queued while we were offline, in order, and
+// then lets Send go straight to the server again. If the connection fails
+// again, the rest stays queued for the next one.
+func (c *Client) flushQueue() {
+	for {
+		c.stateMu.Lock()
+		if len(c.queued) == 0 {
+			c.connected = true
+			c.stateMu.Unlock()
+			return
+		}
+		text := c.queued[0]
+		c.queued = c.queued[1:]
+		c.stateMu.Unlock()
+
+		err := c.sendText(text)
+		if errors.Is(err, errNotSent) {
+			c.stateMu.Lock()
+			c.queued = append([]queuedText{text}, c.queued...)
+			c.stateMu.Unlock()
+			return
+		}
+		if err != nil {
+			c.emit(Event{Type: Error, Err: errors.New("Could not send queued message: " + err.Error())})
+		}
+	}
+}
+
+func (c *Client) setDisconnected() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.connected = false
+}
+
+func (c *Client) currentConnection() *connection {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.current
+}
+
+// Close cleanly closes the connection by sending a close message and then
+// waiting (with timeout) for the server to close the connection.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		cn := c.currentConnection()
+		select {
+		case <-cn.closed:
+			// Lost already, nothing to say goodbye on
+		default:
+			err = cn.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second))
+		}
+
+		select {
+		case <-c.done:
+		case <-time.After(time.Second):
+		}
+		c.currentConnection().conn.Close()
+	})
+	return err
+}
+
+func (c *Client) Username() string {
+	return c.cfg.Username
+}
+
+func (c *Client) Room() string {
+	return c.cfg.Room
+}
+
+func (c *Client) write(msg comm.Message) error {
+	return c.writeFrame("", msg)
+}
+
+// request sends msg and waits for the server's reply to it
+func (c *Client) request(ctx context.Context, msg comm.Message) (comm.Message, error) {
+	id := uuid.New().String()
+	reply := make(chan comm.Message, 1)
+	c.requestsMu.Lock()
+	c.requests[id] = reply
+	c.requestsMu.Unlock()
+	defer func() {
+		c.requestsMu.Lock()
+		delete(c.requests, id)
+		c.requestsMu.Unlock()
+	}()
+
+	err := c.writeFrame(id, msg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-reply:
+		if errorMessage, ok := msg.(*comm.Error); ok {
+			return nil, errorMessage
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// deliverReply hands msg to the request waiting for it. It returns false if
+// nobody is waiting for a reply with this id.
+func (c *Client) deliverReply(id string, msg comm.Message) bool {
+	if id == "" {
+		return false
+	}
+	c.requestsMu.Lock()
+	reply, ok := c.requests[id]
+	c.requestsMu.Unlock()
+	if ok {
+		// Only the first reply counts
+		select {
+		case reply <- msg:
+		default:
+		}
+	}
+	return ok
+}
+
+// writeFrame hands msg to the write loop and waits until it is written
+func (c *Client) writeFrame(id string, msg comm.Message) error {
+	result := make(chan error, 1)
+	select {
+	case c.outgoing <- frame{id: id, msg: msg, result: result}:
+		return <-result
+	case <-c.done:
+		return ErrClosed
+	case <-c.closing:
+		return ErrClosed
+	}
+}
+
+// sendFrame sends msg on cn in an envelope for the negotiated protocol
+// version. Only the write loop calls this once the client is running.
+func sendFrame(cn *connection, id string, msg comm.Message) error {
+	envelope, err := comm.Encode(cn.version, id, msg)
+	if err != nil {
+		return err
+	}
+	return cn.conn.WriteJSON(envelope)
+}
+
+func (c *Client) dial(ctx context.Context, path string) (*websocket.Conn, error) {
+	header := http.Header{}
+	if c.cfg.Password != "" {
+		token, err := c.loginToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, response, err := c.cfg.Dialer.DialContext(ctx, c.serverURL("ws", path), header)
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusUnauthorized {
+			// Log in again next time
+			c.token = nil
+			return nil, fmt.Errorf("dial %s: %w", path, ErrUnauthorized)
+		}
+		if response != nil {
+			return nil, fmt.Errorf("dial %s: handshake failed with status %d: %w", path, response.StatusCode, err)
+		}
+		return nil, fmt.Errorf("dial %s: %w", path, err)
+	}
+	return conn, nil
+}
+
+// serverURL returns the URL of path on the server, switching scheme to its
+// secure variant if we use TLS
+func (c *Client) serverURL(scheme string, path string) string {
+	if c.cfg.TLS != nil {
+		scheme += "s"
+	}
+	u := url.URL{Scheme: scheme, Host: net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port)), Path: path}
+	return u.String()
+}
+
+// join sends our join request on cn and waits for the server's answer
+func (c *Client) join(cn *connection) error {
+	join := &comm.Join{Username: c.cfg.Username, Room: c.cfg.Room, Versions: comm.SupportedVersions, Session: c.session}
+	// Tell the server which key we hold, so it can skip the key exchange if
+	// the key is still current
+	if epoch, roomKey := c.keys.GetRoomKey(); roomKey != nil {
+		join.Epoch = epoch
+	}
+
+	joinId := uuid.New().String()
+	err := sendFrame(cn, joinId, join)
+	if err != nil {
+		return errors.New("send join: " + err.Error())
+	}
+
+	for {
+		var envelope comm.Envelope
+		err = cn.conn.ReadJSON(&envelope)
+		if err != nil {
+			return errors.New("read join reply: " + err.Error())
+		}
+		if envelope.Id != joinId {
+			continue
+		}
+		msg, err := comm.Decode(&envelope)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *comm.JoinAccepted:
+			cn.version = msg.Version
+			cn.resumed = msg.Resumed
+			return nil
+		case *comm.Error:
+			return msg
+		case *comm.Shutdown:
+			return errors.New(msg.Message)
+		}
+		return errors.New("could not join chat")
+	}
+}
+
+// markReady is called whenever we get a room key. The first time on each
+// connection, it lets finishJoin go on. Only the read loop calls it.
+func (c *Client) markReady() {
+	if !c.isReady() {
+		close(c.current.ready)
+	}
+}
+
+func (c *Client) isReady() bool {
+	select {
+	case <-c.current.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// A keyExchange is our side of one exchange. As the key hub, we also keep
+// the member the server asked us to hand the key to.
+type keyExchange struct {
+	exchange *util.KeyExchange
+	member   string
+}
+
+// offerKey starts the key hub's side of a key exchange with member, who is
+// new or needs the key of a new epoch
+func (c *Client) offerKey(id string, member string) {
+	exchange, offer, err := util.OfferKey(c.cfg.Identity, c.cfg.Username)
+	if err != nil {
+		c.emit(Event{Type: Error, Err: errors.New("key exchange: " + err.Error())})
+		return
+	}
+	c.exchanges[id] = &keyExchange{exchange: exchange, member: member}
+	c.writeFrame(id, &comm.KeyOffer{SignedKey: offer})
+}
+
+// acceptKey answers the key hub's offer with our own ephemeral key
+func (c *Client) acceptKey(id string, msg *comm.KeyOffer) {
+	exchange, accept, err := util.AcceptKey(c.cfg.Identity, c.cfg.Username, &msg.SignedKey)
+	if err != nil {
+		c.emit(Event{Type: Error, Err: errors.New("key exchange: " + err.Error())})
+		return
+	}
+	c.observePeer(&msg.SignedKey)
+	c.exchanges[id] = &keyExchange{exchange: exchange}
+	c.writeFrame(id, &comm.KeyAccept{SignedKey: accept})
+}
+
+// shareRoomKey finishes the key hub's side of an exchange. The key only goes
+// to the member the server named when it started the exchange, and not while
+// that member's identity key differs from the one we know, since anyone can
+// sign a key for any username with an identity of their own.
+func (c *Client) shareRoomKey(id string, msg *comm.KeyAccept) {
+	exchange, ok := c.exchanges[id]
+	if !ok || exchange.member == "" {
+		return
+	}
+	delete(c.exchanges, id)
+
+	if msg.SignedKey.Username != exchange.member {
+		c.emit(Event{Type: Error, Username: exchange.member, Err: fmt.Errorf("key exchange: expected a key signed by %s, got one signed by %s", exchange.member, msg.SignedKey.Username)})
+		return
+	}
+	wrappedKey, err := c.keys.WrapRoomKey(exchange.exchange, &msg.SignedKey)
+	if err != nil {
+		c.emit(Event{Type: Error, Err: errors.New("key exchange: " + err.Error())})
+		return
+	}
+	c.observePeer(&msg.SignedKey)
+	if c.cfg.TrustStore.Check(exchange.member, msg.SignedKey.IdentityKey) == Changed {
+		c.emit(Event{Type: IdentityNotice, Username: exchange.member, Trust: Changed,
+			Err:  errors.New("identity key has changed"),
+			Text: fmt.Sprintf("Not handing the room key to %s until you verify their new identity key", exchange.member)})
+		return
+	}
+	c.writeFrame(id, &comm.RoomKey{Ciphertext: wrappedKey})
+}
+
+// receiveRoomKey finishes our side of an exchange
+func (c *Client) receiveRoomKey(id string, msg *comm.RoomKey) {
+	exchange, ok := c.exchanges[id]
+	if !ok {
+		return
+	}
+	delete(c.exchanges, id)
+
+	epoch, err := c.keys.UnwrapRoomKey(exchange.exchange, msg.Ciphertext)
+	if err != nil {
+		c.emit(Event{Type: Error, Err: errors.New("key exchange: " + err.Error())})
+		return
+	}
+	if c.isReady() {
+		c.emit(Event{Type: Notice, Text: fmt.Sprintf("Room key rotated (epoch %d)", epoch)})
+	}
+	c.markReady()
+	c.processPending()
+}
+
+func (c *Client) handleIdentity(msg *comm.Identity) {
+	err := msg.SignedKey.Verify()
+	if err == nil && msg.SignedKey.Username != msg.Username {
+		err = errors.New("signed for " + msg.SignedKey.Username)
+	}
+	if err != nil {
+		c.emit(Event{Type: Error, Username: msg.Username, Err: errors.New("invalid identity announcement: " + err.Error())})
+		return
+	}
+	c.observePeer(&msg.SignedKey)
+}
+
+// readLoop handles the frames on cn until it fails
+func (c *Client) readLoop(cn *connection) error {
+	for {
+		var envelope comm.Envelope
+		err := cn.conn.ReadJSON(&envelope)
+		if err != nil {
+			return err
+		}
+
+		msg, err := comm.Decode(&envelope)
+		if err != nil {
+			// Probably a newer server; skip what we do not understand
+			c.emit(Event{Type: Error, Err: err})
+			continue
+		}
+
+		id := envelope.Id
+		if c.deliverReply(id, msg) {
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *comm.Text:
+			c.decryptText(msg)
+		case *comm.Identity:
+			c.handleIdentity(msg)
+		case *comm.SenderKey:
+			c.handleSenderKey(msg)
+		case *comm.ExchangeKeys:
+			// Only the key hub should receive this
+			c.offerKey(id, msg.Username)
+		case *comm.KeyAccept:
+			// Only the key hub should receive this
+			c.shareRoomKey(id, msg)
+		case *comm.KeyOffer:
+			c.acceptKey(id, msg)
+		case *comm.RoomKey:
+			c.receiveRoomKey(id, msg)
+		case *comm.GenerateKeys:
+			// Only the key hub should receive this. Without a room key
+			// there is nothing we can do on this connection.
+			err = c.keys.GenerateKeys(msg.Epoch)
+			if err != nil {
+				return err
+			}
+			if msg.Epoch > 0 && c.isReady() {
+				c.emit(Event{Type: Notice, Text: fmt.Sprintf("Room key rotated (epoch %d)", msg.Epoch)})
+			}
+			c.markReady()
+			c.processPending()
+		case *comm.Notice:
+			c.emit(Event{Type: Notice, Text: msg.Text})
+		case *comm.Shutdown:
+			c.emit(Event{Type: ServerShutdown, Text: msg.Message})
+		case *comm.Presence:
+			c.emit(Event{Type: Presence, Username: msg.Username, Presence: msg.Status, Operator: msg.Operator, Trust: c.peerTrust(msg.Username)})
+		case *comm.Kicked:
+			cn.kicked = msg
+			c.emit(Event{Type: Kicked, Username: msg.By, Text: msg.Reason})
+		case *comm.Error:
+			c.emit(Event{Type: Error, Err: msg})
+		}
+	}
+}
+
+func (c *Client) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case frame := <-c.outgoing:
+			// If this fails, the read loop notices too and reconnects
+			frame.result <- sendFrame(c.currentConnection(), frame.id, frame.msg)
+		}
+	}
+}
+
+func (c *Client) emit(event Event) {
+	c.eventsMu.RLock()
+	defer c.eventsMu.RUnlock()
+	if c.eventsClosed {
+		return
+	}
+
+	select {
+	case c.events <- event:
+	case <-c.closing:
+	case <-c.done:
+	}
+}
+
+func (c *Client) closeEvents() {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	c.eventsClosed = true
+	close(c.events)
+}
@@ -0,0 +1,53 @@
+package chatclient
+
+import "websocket-chat/comm"
+
+type EventType int
+
+const (
+	// A decrypted chat message from another member of the room
+	ChatMessage EventType = iota
+	// Something happened that the user may want to know about, described in
+	// Text
+	Notice
+	// Something went wrong with a single message, the connection is still up
+	Error
+	// A message claiming to be from Username failed authentication. Either it
+	// was modified in transit or it was not encrypted with the room key.
+	TamperWarning
+	// Username presented an identity key that is unverified or different
+	// from the one we know. See Trust.
+	IdentityNotice
+	// The connection to the server was lost for good. This is the last event
+	// before the Messages channel is closed.
+	Disconnected
+	// The connection was lost and the client is about to try again. Err says
+	// what went wrong and Text when the next attempt is.
+	Reconnecting
+	// The client is back in the room after Reconnecting
+	Reconnected
+	// Username joined, left, went idle or came back. See Presence.
+	Presence
+	// The server is shutting down, as Text explains. The connection drops
+	// right after, and the client reconnects unless DisableReconnect is set.
+	ServerShutdown
+	// The operator Username removed us from the room, for the reason in
+	// Text. The client does not reconnect, so Disconnected follows.
+	Kicked
+)
+
+type Event struct {
+	Type     EventType
+	Username string
+	Text     string
+	Err      error
+	// How much the sender's identity key is trusted, for ChatMessage and
+	// IdentityNotice events
+	Trust TrustLevel
+	// What happened to Username, for Presence events
+	Presence comm.PresenceStatus
+	// Whether Username is a room operator, for Presence events
+	Operator bool
+	// Whether a ChatMessage was sent to us alone
+	Private bool
+}
@@ -0,0 +1,77 @@
+package chatclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"websocket-chat/comm"
+	"websocket-chat/util"
+)
+
+// History fetches up to limit of the room's earlier messages, oldest first.
+// A message can only be read if we hold the room key of its epoch and its
+// sender's chain announcement is part of the history too. The messages that
+// cannot be read are counted in a Notice at the end.
+func (c *Client) History(ctx context.Context, limit int) ([]Event, error) {
+	reply, err := c.request(ctx, &comm.History{Limit: limit})
+	if err != nil {
+		return nil, errors.New("Error fetching history: " + err.Error())
+	}
+	result, ok := reply.(*comm.HistoryResult)
+	if !ok {
+		return nil, fmt.Errorf("Error fetching history: unexpected %s reply", reply.Kind())
+	}
+
+	// Chains are rebuilt from the announcements in the history itself, so
+	// replaying it does not disturb the chains we are reading live messages
+	// with
+	chains := make(map[chainId]*util.SenderChain)
+	var events []Event
+	unreadable := 0
+	for i := range result.Messages {
+		msg, err := comm.Decode(&result.Messages[i])
+		if err != nil {
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *comm.SenderKey:
+			roomKey := c.keys.GetRoomKeyForEpoch(msg.Epoch)
+			if roomKey == nil {
+				continue
+			}
+			plaintext, err := msg.Decrypt(roomKey)
+			if err != nil {
+				continue
+			}
+			_, chain, err := parseSenderKey(plaintext)
+			if err != nil {
+				continue
+			}
+			chains[chainId{username: msg.Username, epoch: msg.Epoch}] = chain
+		case *comm.Text:
+			chain := chains[chainId{username: msg.Username, epoch: msg.Epoch}]
+			if chain == nil {
+				unreadable++
+				continue
+			}
+			messageKey, err := chain.MessageKey(msg.Seq)
+			if err != nil {
+				unreadable++
+				continue
+			}
+			plaintext, err := msg.Decrypt(messageKey)
+			if err != nil {
+				unreadable++
+				continue
+			}
+			chain.Commit(msg.Seq)
+			events = append(events, Event{Type: ChatMessage, Username: msg.Username, Text: string(plaintext), Trust: c.peerTrust(msg.Username)})
+		}
+	}
+
+	if unreadable > 0 {
+		events = append(events, Event{Type: Notice, Text: fmt.Sprintf("%d earlier messages could not be decrypted", unreadable)})
+	}
+	return events, nil
+}
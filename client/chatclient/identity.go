@@ -0,0 +1,90 @@
+package chatclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"websocket-chat/util"
+)
+
+// Fingerprint is the short form of our own identity key
+func (c *Client) Fingerprint() string {
+	return util.Fingerprint(c.cfg.Identity.PublicKey())
+}
+
+// SafetyNumber returns the number to compare with username out of band. It is
+// the same on both ends unless the server tampered with the key exchange.
+func (c *Client) SafetyNumber(username string) (string, error) {
+	identityKey, err := c.peerKey(username)
+	if err != nil {
+		return "", err
+	}
+	return util.SafetyNumber(c.cfg.Username, c.cfg.Identity.PublicKey(), username, identityKey), nil
+}
+
+// PeerFingerprint is the short form of the identity key username is using
+func (c *Client) PeerFingerprint(username string) (string, error) {
+	identityKey, err := c.peerKey(username)
+	if err != nil {
+		return "", err
+	}
+	return util.Fingerprint(identityKey), nil
+}
+
+// VerifyPeer marks the identity key username is currently using as verified.
+// Only call this after comparing safety numbers.
+func (c *Client) VerifyPeer(username string) error {
+	identityKey, err := c.peerKey(username)
+	if err != nil {
+		return err
+	}
+	return c.cfg.TrustStore.Verify(username, identityKey)
+}
+
+func (c *Client) peerKey(username string) ([]byte, error) {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	identityKey, ok := c.peers[username]
+	if !ok {
+		return nil, fmt.Errorf("no identity key seen for %s", username)
+	}
+	return identityKey, nil
+}
+
+func (c *Client) peerTrust(username string) TrustLevel {
+	if username == c.cfg.Username {
+		return Verified
+	}
+	identityKey, err := c.peerKey(username)
+	if err != nil {
+		return Unverified
+	}
+	return c.cfg.TrustStore.Check(username, identityKey)
+}
+
+// observePeer records the identity key a peer presented and tells the user if
+// it is new or different from the one we know.
+func (c *Client) observePeer(signedKey *util.SignedKey) {
+	if signedKey.Username == c.cfg.Username {
+		return
+	}
+
+	c.peersMu.Lock()
+	previous, seen := c.peers[signedKey.Username]
+	c.peers[signedKey.Username] = signedKey.IdentityKey
+	c.peersMu.Unlock()
+	if seen && bytes.Equal(previous, signedKey.IdentityKey) {
+		return
+	}
+
+	trust := c.cfg.TrustStore.Check(signedKey.Username, signedKey.IdentityKey)
+	switch trust {
+	case Unverified:
+		c.emit(Event{Type: IdentityNotice, Username: signedKey.Username, Trust: trust,
+			Text: fmt.Sprintf("%s's identity is not verified", signedKey.Username)})
+	case Changed:
+		c.emit(Event{Type: IdentityNotice, Username: signedKey.Username, Trust: trust,
+			Err:  errors.New("identity key has changed"),
+			Text: fmt.Sprintf("%s's identity key has changed since you last saw them", signedKey.Username)})
+	}
+}
@@ -0,0 +1,63 @@
+package chatclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"websocket-chat/comm"
+)
+
+// Log in again this long before the token expires, so that it does not run
+// out in the middle of a reconnect
+const tokenRenewMargin = time.Minute
+
+// loginToken returns a token for /ws, logging in if we have none or it is
+// about to expire
+func (c *Client) loginToken(ctx context.Context) (string, error) {
+	if c.token != nil && time.Until(time.Unix(c.token.Expires, 0)) > tokenRenewMargin {
+		return c.token.Token, nil
+	}
+	token, err := c.login(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	return token.Token, nil
+}
+
+// login exchanges our password for a token at /login
+func (c *Client) login(ctx context.Context) (*comm.LoginResult, error) {
+	body, err := json.Marshal(comm.Login{Username: c.cfg.Username, Password: c.cfg.Password})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serverURL("http", "/login"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("login: %w", ErrUnauthorized)
+	}
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, fmt.Errorf("login: server answered %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+
+	var result comm.LoginResult
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	return &result, nil
+}
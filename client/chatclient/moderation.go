@@ -0,0 +1,59 @@
+package chatclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"websocket-chat/comm"
+)
+
+// moderate sends an operator's request and returns the server's account of
+// what was done, which the rest of the room gets as a notice
+func (c *Client) moderate(ctx context.Context, req *comm.Moderate) (string, error) {
+	reply, err := c.request(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("Error trying to %s %s: %w", req.Action, req.Username, err)
+	}
+	result, ok := reply.(*comm.Moderated)
+	if !ok {
+		return "", errors.New("Error moderating: unexpected " + string(reply.Kind()) + " reply")
+	}
+	return result.Text, nil
+}
+
+// Kick removes username from the room. Only room operators may do this, and
+// the rest of the moderation methods.
+func (c *Client) Kick(ctx context.Context, username string, reason string) (string, error) {
+	return c.moderate(ctx, &comm.Moderate{Action: comm.ActionKick, Username: username, Reason: reason})
+}
+
+// Ban removes username from the room and keeps it out for duration, or until
+// Unban if duration is 0. The ban matches the username, or the session or IP
+// address the member is connected with.
+func (c *Client) Ban(ctx context.Context, username string, match comm.BanMatch, duration time.Duration, reason string) (string, error) {
+	return c.moderate(ctx, &comm.Moderate{Action: comm.ActionBan, Username: username, Match: match, Duration: seconds(duration), Reason: reason})
+}
+
+// Unban lifts every ban of username from the room
+func (c *Client) Unban(ctx context.Context, username string) (string, error) {
+	return c.moderate(ctx, &comm.Moderate{Action: comm.ActionUnban, Username: username})
+}
+
+// Mute keeps username from sending messages to the room for duration, or
+// until Unmute if duration is 0
+func (c *Client) Mute(ctx context.Context, username string, duration time.Duration, reason string) (string, error) {
+	return c.moderate(ctx, &comm.Moderate{Action: comm.ActionMute, Username: username, Duration: seconds(duration), Reason: reason})
+}
+
+func (c *Client) Unmute(ctx context.Context, username string) (string, error) {
+	return c.moderate(ctx, &comm.Moderate{Action: comm.ActionUnmute, Username: username})
+}
+
+// seconds rounds up, so that short durations do not become permanent
+func seconds(duration time.Duration) int64 {
+	if duration <= 0 {
+		return 0
+	}
+	return int64((duration + time.Second - 1) / time.Second)
+}
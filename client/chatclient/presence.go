@@ -0,0 +1,43 @@
+package chatclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"websocket-chat/comm"
+)
+
+// A Member is someone currently in the room
+type Member struct {
+	Username string
+	// Idle members have not sent anything for a while
+	Idle bool
+	// How much the member's identity key is trusted
+	Trust TrustLevel
+	// Operators can kick, ban and mute other members
+	Operator bool
+}
+
+// Members asks the server who is in the room, including ourselves. The list is
+// sorted by username. Presence events say how it changes afterwards.
+func (c *Client) Members(ctx context.Context) ([]Member, error) {
+	reply, err := c.request(ctx, &comm.Who{})
+	if err != nil {
+		return nil, errors.New("Error fetching members: " + err.Error())
+	}
+	result, ok := reply.(*comm.Members)
+	if !ok {
+		return nil, fmt.Errorf("Error fetching members: unexpected %s reply", reply.Kind())
+	}
+
+	members := make([]Member, 0, len(result.Members))
+	for _, member := range result.Members {
+		members = append(members, Member{
+			Username: member.Username,
+			Idle:     member.Idle,
+			Operator: member.Operator,
+			Trust:    c.peerTrust(member.Username),
+		})
+	}
+	return members, nil
+}
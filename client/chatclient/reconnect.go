@@ -0,0 +1,112 @@
+package chatclient
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Delay before the first reconnect attempt. It doubles with every failed
+// attempt, up to maxReconnectDelay.
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+	// How long a single attempt may take, including the key exchange
+	reconnectTimeout = 30 * time.Second
+)
+
+// run reads from the current connection and replaces it whenever it is lost,
+// until the client is closed
+func (c *Client) run(cn *connection) {
+	defer c.closeEvents()
+	defer close(c.done)
+
+	for {
+		err := c.readLoop(cn)
+		cn.conn.Close()
+		close(cn.closed)
+		c.setDisconnected()
+		select {
+		case <-c.closing:
+			return
+		default:
+		}
+		if cn.kicked != nil {
+			c.emit(Event{Type: Disconnected, Err: fmt.Errorf("%w by %s", ErrKicked, cn.kicked.By)})
+			return
+		}
+		if c.cfg.DisableReconnect {
+			c.emit(Event{Type: Disconnected, Err: err})
+			return
+		}
+
+		cn = c.reconnect(err)
+		if cn == nil {
+			return
+		}
+	}
+}
+
+// reconnect dials the server again, backing off between attempts. It returns
+// nil if the client was closed in the meantime.
+func (c *Client) reconnect(err error) *connection {
+	delay := minReconnectDelay
+	for attempt := 1; ; attempt++ {
+		// Spread out the attempts of clients that lost the same server
+		wait := delay + rand.N(delay/2)
+		c.emit(Event{Type: Reconnecting, Err: err, Text: fmt.Sprintf("Reconnecting in %s (attempt %d)", wait.Round(100*time.Millisecond), attempt)})
+		select {
+		case <-time.After(wait):
+		case <-c.closing:
+			return nil
+		}
+
+		var cn *connection
+		cn, err = c.connectOnce()
+		if err == nil {
+			go c.resume(cn)
+			return cn
+		}
+		if Banned(err) {
+			c.emit(Event{Type: Disconnected, Err: err})
+			return nil
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// connectOnce makes one reconnect attempt, giving up early if the client is
+// closed
+func (c *Client) connectOnce() (*connection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return c.connect(ctx)
+}
+
+// resume finishes joining on a new connection while the run loop reads from
+// it
+func (c *Client) resume(cn *connection) {
+	ctx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
+	defer cancel()
+	err := c.finishJoin(ctx, cn)
+	if err != nil {
+		// Drop the connection so that the run loop tries again
+		c.emit(Event{Type: Error, Err: fmt.Errorf("rejoin: %w", err)})
+		cn.conn.Close()
+		return
+	}
+
+	if cn.resumed {
+		c.emit(Event{Type: Reconnected, Text: "Reconnected, session resumed"})
+	} else {
+		c.emit(Event{Type: Reconnected, Text: "Reconnected with a new room key"})
+	}
+}
@@ -0,0 +1,225 @@
+package chatclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"websocket-chat/comm"
+	"websocket-chat/util"
+
+	"github.com/google/uuid"
+)
+
+// Messages for an epoch we have no key for yet are held back, up to this many
+const maxPendingMessages = 100
+
+// Every member has its own sender chain for each room key epoch
+type chainId struct {
+	username string
+	epoch    uint64
+}
+
+// A senderKeyAnnouncement hands our chain to the rest of the room. It is
+// encrypted with the room key, which only members got through the pairwise
+// key exchange.
+type senderKeyAnnouncement struct {
+	Index    uint64 `json:"index"`
+	ChainKey []byte `json:"chainKey"`
+	// Set by new members, asking everyone else to announce their chains
+	Request bool `json:"request,omitempty"`
+}
+
+// ownChain returns the chain we send with in the current epoch and its id,
+// starting a new one if the room key has rotated. The last return value
+// besides the error is true if the chain is new and still has to be
+// announced.
+func (c *Client) ownChain() (uint64, *util.SenderChain, string, bool, error) {
+	epoch, _ := c.keys.GetRoomKey()
+
+	c.chainsMu.Lock()
+	defer c.chainsMu.Unlock()
+	if c.myChain != nil && c.myChainEpoch == epoch {
+		return epoch, c.myChain, c.myChainId, false, nil
+	}
+
+	chain, err := util.NewSenderChain()
+	if err != nil {
+		return 0, nil, "", false, err
+	}
+	c.myChain = chain
+	c.myChainEpoch = epoch
+	c.myChainId = uuid.New().String()
+	c.pruneChains(epoch)
+	return epoch, chain, c.myChainId, true, nil
+}
+
+// senderKeyMessage builds the announcement of our current chain
+func (c *Client) senderKeyMessage(request bool) (*comm.SenderKey, error) {
+	epoch, chain, id, _, err := c.ownChain()
+	if err != nil {
+		return nil, err
+	}
+	roomKey := c.keys.GetRoomKeyForEpoch(epoch)
+	if roomKey == nil {
+		return nil, errors.New("no room key")
+	}
+
+	index, chainKey := chain.State()
+	announcement, err := json.Marshal(senderKeyAnnouncement{Index: index, ChainKey: chainKey, Request: request})
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &comm.SenderKey{Username: c.cfg.Username, Epoch: epoch, Chain: id}
+	err = msg.Encrypt(announcement, roomKey)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *Client) announceSenderKey(request bool) error {
+	msg, err := c.senderKeyMessage(request)
+	if err != nil {
+		return errors.New("Error announcing sender key: " + err.Error())
+	}
+	return c.write(msg)
+}
+
+// nextMessageKey returns the key and chain index for the next message we
+// send, announcing a new chain first if the room key has rotated
+func (c *Client) nextMessageKey() (uint64, uint64, []byte, error) {
+	epoch, chain, _, isNew, err := c.ownChain()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if isNew {
+		err = c.announceSenderKey(false)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	index, messageKey := chain.Next()
+	return epoch, index, messageKey, nil
+}
+
+func (c *Client) handleSenderKey(msg *comm.SenderKey) {
+	roomKey := c.keys.GetRoomKeyForEpoch(msg.Epoch)
+	if roomKey == nil {
+		c.holdBack(msg, msg.Username, msg.Epoch)
+		return
+	}
+
+	plaintext, err := msg.Decrypt(roomKey)
+	if err != nil {
+		c.emit(Event{Type: TamperWarning, Username: msg.Username, Err: errors.New("sender key: " + err.Error())})
+		return
+	}
+	announcement, chain, err := parseSenderKey(plaintext)
+	if err != nil {
+		c.emit(Event{Type: Error, Username: msg.Username, Err: err})
+		return
+	}
+
+	c.chainsMu.Lock()
+	c.chains[chainId{username: msg.Username, epoch: msg.Epoch}] = chain
+	c.chainsMu.Unlock()
+
+	// A new member needs our chain to read what we send
+	if announcement.Request {
+		err = c.announceSenderKey(false)
+		if err != nil {
+			c.emit(Event{Type: Error, Err: err})
+		}
+	}
+}
+
+func parseSenderKey(plaintext []byte) (*senderKeyAnnouncement, *util.SenderChain, error) {
+	var announcement senderKeyAnnouncement
+	err := json.Unmarshal(plaintext, &announcement)
+	if err != nil {
+		return nil, nil, errors.New("invalid sender key: " + err.Error())
+	}
+	chain, err := util.RestoreSenderChain(announcement.Index, announcement.ChainKey)
+	if err != nil {
+		return nil, nil, errors.New("invalid sender key: " + err.Error())
+	}
+	return &announcement, chain, nil
+}
+
+// decryptText opens a chat message with the sender's chain
+func (c *Client) decryptText(msg *comm.Text) {
+	if c.keys.GetRoomKeyForEpoch(msg.Epoch) == nil {
+		c.holdBack(msg, msg.Username, msg.Epoch)
+		return
+	}
+
+	c.chainsMu.Lock()
+	chain := c.chains[chainId{username: msg.Username, epoch: msg.Epoch}]
+	c.chainsMu.Unlock()
+	if chain == nil {
+		c.emit(Event{Type: Error, Username: msg.Username, Err: fmt.Errorf("no sender key from %s for epoch %d", msg.Username, msg.Epoch)})
+		return
+	}
+
+	messageKey, err := chain.MessageKey(msg.Seq)
+	if err != nil {
+		c.emit(Event{Type: Error, Username: msg.Username, Err: errors.New("decryption: " + err.Error())})
+		return
+	}
+	decryptedBytes, err := msg.Decrypt(messageKey)
+	if errors.Is(err, util.ErrTampered) {
+		c.emit(Event{Type: TamperWarning, Username: msg.Username, Err: err})
+		return
+	}
+	if err != nil {
+		c.emit(Event{Type: Error, Username: msg.Username, Err: errors.New("decryption: " + err.Error())})
+		return
+	}
+	chain.Commit(msg.Seq)
+	c.emit(Event{Type: ChatMessage, Username: msg.Username, Text: string(decryptedBytes), Trust: c.peerTrust(msg.Username), Private: msg.To != ""})
+}
+
+// holdBack keeps a message for a room key epoch we have not received yet
+func (c *Client) holdBack(msg comm.Message, username string, epoch uint64) {
+	currentEpoch, _ := c.keys.GetRoomKey()
+	if epoch <= currentEpoch {
+		c.emit(Event{Type: Error, Username: username, Err: fmt.Errorf("no room key for epoch %d", epoch)})
+		return
+	}
+
+	c.chainsMu.Lock()
+	defer c.chainsMu.Unlock()
+	if len(c.pending) >= maxPendingMessages {
+		c.pending = c.pending[1:]
+	}
+	c.pending = append(c.pending, msg)
+}
+
+// processPending handles held back messages whose room key has arrived
+func (c *Client) processPending() {
+	c.chainsMu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.chainsMu.Unlock()
+
+	for _, msg := range pending {
+		switch msg := msg.(type) {
+		case *comm.Text:
+			c.decryptText(msg)
+		case *comm.SenderKey:
+			c.handleSenderKey(msg)
+		}
+	}
+}
+
+// pruneChains forgets chains from epochs older than the previous one. Must be
+// called with c.chainsMu held.
+func (c *Client) pruneChains(epoch uint64) {
+	for id := range c.chains {
+		if id.epoch+1 < epoch {
+			delete(c.chains, id)
+		}
+	}
+}
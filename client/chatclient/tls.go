@@ -0,0 +1,74 @@
+package chatclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"websocket-chat/util"
+)
+
+// TLSOptions says how to check the server's certificate and which
+// certificate, if any, to present to it
+type TLSOptions struct {
+	// PEM bundle of CAs to trust instead of the system's
+	CAFile string
+	// Public key pins, as printed by the server. The server's certificate
+	// must match one of them. If Pins is set and CAFile is not, the pins
+	// replace CA verification, which allows self-signed certificates.
+	Pins []string
+	// Client certificate and key for servers that map certificates to
+	// usernames. The certificate's common name must be our username.
+	CertFile string
+	KeyFile  string
+}
+
+// NewTLSConfig builds the tls.Config to put in Config.TLS
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CAFile != "" {
+		pool, err := util.LoadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, errors.New("Error loading client certificate: " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.Pins) == 0 {
+		return config, nil
+	}
+	pins := make(map[string]bool)
+	for _, pin := range opts.Pins {
+		parsed, err := util.ParsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+		pins[parsed] = true
+	}
+	if opts.CAFile == "" {
+		// The pin is all we check. VerifyConnection still runs.
+		config.InsecureSkipVerify = true
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		return checkPin(state.PeerCertificates[0], pins)
+	}
+	return config, nil
+}
+
+func checkPin(cert *x509.Certificate, pins map[string]bool) error {
+	pin := util.CertificatePin(cert)
+	if !pins[pin] {
+		return fmt.Errorf("server certificate %s does not match any pin", pin)
+	}
+	return nil
+}
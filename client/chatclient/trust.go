@@ -0,0 +1,116 @@
+package chatclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type TrustLevel int
+
+const (
+	// We have seen this identity key before, or it is the first key seen for
+	// the username, but nobody has compared safety numbers yet
+	Unverified TrustLevel = iota
+	// The user compared safety numbers and confirmed this identity key
+	Verified
+	// The username is now using a different identity key than the one we
+	// recorded for it. Either they reinstalled, or someone is impersonating
+	// them.
+	Changed
+)
+
+func (t TrustLevel) String() string {
+	switch t {
+	case Verified:
+		return "verified"
+	case Changed:
+		return "changed"
+	}
+	return "unverified"
+}
+
+type knownPeer struct {
+	IdentityKey []byte `json:"identityKey"`
+	Verified    bool   `json:"verified"`
+}
+
+// A TrustStore remembers the identity key first seen for each username
+// (trust on first use) and which of those keys the user has verified.
+type TrustStore struct {
+	path  string
+	peers map[string]*knownPeer
+	mu    sync.Mutex
+}
+
+// LoadTrustStore reads the known peers file at path. An empty path gives an
+// in-memory store that is forgotten when the program exits.
+func LoadTrustStore(path string) (*TrustStore, error) {
+	t := &TrustStore{path: path, peers: make(map[string]*knownPeer)}
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &t.peers)
+	if err != nil {
+		return nil, errors.New("invalid known peers file: " + err.Error())
+	}
+	return t, nil
+}
+
+// Check returns how much we trust identityKey for username. The first key
+// seen for a username is recorded.
+func (t *TrustStore) Check(username string, identityKey []byte) TrustLevel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peer, ok := t.peers[username]
+	if !ok {
+		t.peers[username] = &knownPeer{IdentityKey: identityKey}
+		t.save()
+		return Unverified
+	}
+	if !bytes.Equal(peer.IdentityKey, identityKey) {
+		return Changed
+	}
+	if peer.Verified {
+		return Verified
+	}
+	return Unverified
+}
+
+// Verify records identityKey as the confirmed key for username, replacing any
+// key recorded before.
+func (t *TrustStore) Verify(username string, identityKey []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.peers[username] = &knownPeer{IdentityKey: identityKey, Verified: true}
+	return t.save()
+}
+
+func (t *TrustStore) save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(t.peers, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(t.path), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, data, 0600)
+}
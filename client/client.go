@@ -1,34 +1,132 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"sync"
-	connectionservice "websocket-chat/client/connection-service"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"websocket-chat/client/chatclient"
+	"websocket-chat/client/commands"
+	"websocket-chat/comm"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
+	"golang.org/x/term"
 )
 
+// How many earlier messages to show when joining
+const historyLength = 100
+
 var (
 	message          string
 	app              *tview.Application = tview.NewApplication()
+	chatWindow       *tview.TextView    = tview.NewTextView()
 	chatMessageInput *tview.InputField  = tview.NewInputField()
 	chatChannel                         = make(chan string)
-	closeChannel                        = make(chan struct{})
+	memberList       *tview.TextView    = tview.NewTextView()
+	// Who is in the room. Only touched from the app's event loop once it runs.
+	members = make(map[string]chatclient.Member)
 )
 
+func init() {
+	commands.Register(commands.Command{Name: "verify", Usage: "<user> [confirm]", Help: "Compare safety numbers with user, and mark them verified once they match", Run: handleVerify})
+}
+
 func handleSendMessage(key tcell.Key) {
-	fmt.Println("key:", key)
-	switch key {
-	case tcell.KeyEnter:
-		// send message
-		if message != "" {
-			connectionservice.SendChat(message)
-			yourMessage := fmt.Sprintf("[green]You[white]: %s", message)
-			chatChannel <- yourMessage
-			chatMessageInput.SetText("")
+	if key != tcell.KeyEnter || message == "" {
+		return
+	}
+	if commands.IsCommand(message) {
+		go commands.Default.Run(message, commands.Call{Client: currentClient(), Print: printLine})
+		chatMessageInput.SetText("")
+		return
+	}
+
+	client := currentClient()
+	if client == nil {
+		chatChannel <- "[red]You are not in a room. Use /join <room> to enter one.[white]"
+		return
+	}
+	text := commands.Unescape(message)
+	err := client.Send(text)
+	if err != nil {
+		chatChannel <- fmt.Sprintf("[red]Could not send message: %s[white]", tview.Escape(err.Error()))
+		return
+	}
+	yourMessage := fmt.Sprintf("[green]You[white]: %s", tview.Escape(text))
+	if !client.Connected() {
+		yourMessage += " [gray](queued)[white]"
+	}
+	chatChannel <- yourMessage
+	chatMessageInput.SetText("")
+}
+
+func printLine(line string) {
+	chatChannel <- line
+}
+
+// completeInput completes the command or username being typed. If there is
+// more than one way to go on, the choices are listed in the chat window.
+func completeInput() {
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	line, candidates := commands.Default.Complete(chatMessageInput.GetText(), names)
+	chatMessageInput.SetText(line)
+	if len(candidates) > 0 {
+		chatChannel <- fmt.Sprintf("[gray]%s[white]", tview.Escape(strings.Join(candidates, "  ")))
+	}
+}
+
+// handleVerify shows the safety number shared with a user, or marks their
+// identity key as verified once the numbers have been compared
+func handleVerify(call *commands.Call) error {
+	client := call.Client
+	if client == nil {
+		return commands.ErrNotInRoom
+	}
+	if len(call.Args) == 0 {
+		call.Print(fmt.Sprintf("[yellow]Usage: %s. Your fingerprint is %s[white]", tview.Escape(call.Command.Synopsis()), client.Fingerprint()))
+		return nil
+	}
+
+	username := call.Args[0]
+	if len(call.Args) > 1 && call.Args[1] == "confirm" {
+		err := client.VerifyPeer(username)
+		if err != nil {
+			return fmt.Errorf("could not verify %s: %w", username, err)
 		}
+		call.Print(fmt.Sprintf("[green]%s is now verified[white]", tview.Escape(username)))
+		return nil
 	}
+
+	safetyNumber, err := client.SafetyNumber(username)
+	if err != nil {
+		return fmt.Errorf("could not verify %s: %w", username, err)
+	}
+	fingerprint, _ := client.PeerFingerprint(username)
+	call.Print(fmt.Sprintf("Safety number with %s:\n[::b]%s[::-]\n%s's fingerprint: %s\n"+
+		"Compare the safety number with %s over another channel. If it matches, run /verify %s confirm",
+		tview.Escape(username), safetyNumber, tview.Escape(username), fingerprint, tview.Escape(username), tview.Escape(username)))
+	return nil
+}
+
+// formatUsername marks users whose identity has not been verified
+func formatUsername(username string, trust chatclient.TrustLevel) string {
+	switch trust {
+	case chatclient.Verified:
+		return tview.Escape(username)
+	case chatclient.Changed:
+		return fmt.Sprintf("%s [red](identity changed!)[white]", tview.Escape(username))
+	}
+	return fmt.Sprintf("%s [yellow](unverified)[white]", tview.Escape(username))
 }
 
 func handleChangeInput(txt string) {
@@ -39,53 +137,273 @@ func handleChangeTextView() {
 	app.Draw()
 }
 
+// formatEvent turns an event from client into a line for the chat window
+func formatEvent(client *chatclient.Client, event chatclient.Event) string {
+	switch event.Type {
+	case chatclient.ChatMessage:
+		// Our own messages only come back as part of the history
+		name := "[green]You[white]"
+		if event.Username != client.Username() {
+			name = formatUsername(event.Username, event.Trust)
+		}
+		if action, ok := strings.CutPrefix(event.Text, commands.ActionPrefix); ok {
+			return fmt.Sprintf("* %s %s", name, tview.Escape(action))
+		}
+		if event.Private {
+			name += " [fuchsia](private)[white]"
+		}
+		return fmt.Sprintf("%s: %s", name, tview.Escape(event.Text))
+	case chatclient.IdentityNotice:
+		if event.Trust == chatclient.Changed {
+			return fmt.Sprintf("[red]Warning: %s. Someone may be impersonating them. Use /verify %s to compare safety numbers.[white]", tview.Escape(event.Text), tview.Escape(event.Username))
+		}
+		return fmt.Sprintf("[yellow]%s. Use /verify %s to compare safety numbers.[white]", tview.Escape(event.Text), tview.Escape(event.Username))
+	case chatclient.TamperWarning:
+		return fmt.Sprintf("[yellow]Warning: a message from %s failed verification and was dropped. It may have been tampered with.[white]", tview.Escape(event.Username))
+	case chatclient.Notice:
+		return fmt.Sprintf("[gray]%s[white]", tview.Escape(event.Text))
+	case chatclient.Error:
+		var rejection *comm.Error
+		if chatclient.RateLimited(event.Err) && errors.As(event.Err, &rejection) {
+			return fmt.Sprintf("[yellow]You are sending too fast: %s[white]", tview.Escape(rejection.Message))
+		}
+		return fmt.Sprintf("[red]%s[white]", tview.Escape(event.Err.Error()))
+	case chatclient.Disconnected:
+		return fmt.Sprintf("[red]Disconnected from server: %s[white]", tview.Escape(event.Err.Error()))
+	case chatclient.Reconnecting:
+		return fmt.Sprintf("[yellow]Connection lost: %s. %s[white]", tview.Escape(event.Err.Error()), tview.Escape(event.Text))
+	case chatclient.Reconnected:
+		return fmt.Sprintf("[green]%s[white]", tview.Escape(event.Text))
+	case chatclient.Kicked:
+		if event.Text != "" {
+			return fmt.Sprintf("[red]You were removed from the room by %s: %s[white]", tview.Escape(event.Username), tview.Escape(event.Text))
+		}
+		return fmt.Sprintf("[red]You were removed from the room by %s[white]", tview.Escape(event.Username))
+	case chatclient.ServerShutdown:
+		return fmt.Sprintf("[yellow]The server is going away: %s. Reconnecting once it is back.[white]", tview.Escape(event.Text))
+	case chatclient.Presence:
+		// Idle and active only show in the member list
+		switch event.Presence {
+		case comm.PresenceJoined:
+			return fmt.Sprintf("[gray]%s joined the room[white]", tview.Escape(event.Username))
+		case comm.PresenceLeft:
+			return fmt.Sprintf("[gray]%s left the room[white]", tview.Escape(event.Username))
+		}
+	}
+	return ""
+}
+
+// updateMembers keeps the member list in step with a presence event
+func updateMembers(event chatclient.Event) {
+	switch event.Presence {
+	case comm.PresenceJoined, comm.PresenceActive:
+		members[event.Username] = chatclient.Member{Username: event.Username, Trust: event.Trust, Operator: event.Operator}
+	case comm.PresenceIdle:
+		members[event.Username] = chatclient.Member{Username: event.Username, Idle: true, Trust: event.Trust, Operator: event.Operator}
+	case comm.PresenceLeft:
+		delete(members, event.Username)
+	}
+	renderMembers()
+}
+
+// setMembers replaces the member list with what the server told us
+func setMembers(list []chatclient.Member) {
+	clear(members)
+	for _, member := range list {
+		members[member.Username] = member
+	}
+	renderMembers()
+}
+
+// renderMembers shows the member list sorted by name, operators marked with @
+// and idle members in gray
+func renderMembers() {
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	memberList.Clear()
+	for _, name := range names {
+		label := tview.Escape(name)
+		if client := currentClient(); client != nil && name == client.Username() {
+			label = "You"
+		}
+		if members[name].Operator {
+			label = "@" + label
+		}
+		if members[name].Idle {
+			fmt.Fprintf(memberList, "[gray]%s (idle)[white]\n", label)
+		} else {
+			fmt.Fprintf(memberList, "%s\n", label)
+		}
+	}
+	memberList.SetTitle(fmt.Sprintf("Members (%d)", len(members)))
+}
+
+// refreshMembers fetches the member list again, after reconnecting
+func refreshMembers(client *chatclient.Client) {
+	list, err := client.Members(context.Background())
+	if err != nil {
+		chatChannel <- fmt.Sprintf("[red]%s[white]", tview.Escape(err.Error()))
+		return
+	}
+	app.QueueUpdateDraw(func() {
+		if client == currentClient() {
+			setMembers(list)
+		}
+	})
+}
+
+// chatTitle shows the room and the state of the connection
+func chatTitle(room string, status string) string {
+	return fmt.Sprintf("Go Websocket Chat Demo - %s - %s", tview.Escape(room), status)
+}
+
+// connectionStatus returns the status to show after event, or "" if event
+// does not change it
+func connectionStatus(event chatclient.Event) string {
+	switch event.Type {
+	case chatclient.Reconnecting:
+		return "[yellow]reconnecting[white]"
+	case chatclient.Reconnected:
+		return "[green]connected[white]"
+	case chatclient.Disconnected:
+		return "[red]disconnected[white]"
+	}
+	return ""
+}
+
 func main() {
-	var wg sync.WaitGroup
-	wg.Add(1)
+	hostName := flag.String("host", "localhost", "Server Hostname")
+	hostPort := flag.Int("port", 8080, "Server Port")
+	user := flag.String("username", "PabloDebug", "Username")
+	room := flag.String("room", comm.DefaultRoom, "Chat room to join")
+	login := flag.Bool("login", false, "Log in with a password, for servers that require accounts")
+	identityPath := flag.String("identity", "", "Identity key file (default: <user config dir>/websocket-chat/<username>/identity.pem)")
+	useTLS := flag.Bool("tls", false, "Connect with TLS (wss)")
+	caFile := flag.String("ca", "", "CA bundle to check the server's certificate with, instead of the system's (implies -tls)")
+	pins := flag.String("pin", "", "Comma separated public key pins the server's certificate must match, as printed by the server (implies -tls)")
+	certFile := flag.String("cert", "", "Client certificate for servers that use mutual TLS (implies -tls)")
+	keyFile := flag.String("key", "", "Private key of -cert")
+	flag.Parse()
 
-	go func() {
-		defer wg.Done()
-		connectionservice.ConnectToChatServer(&chatChannel, &closeChannel)
-	}()
+	var tlsConfig *tls.Config
+	if *useTLS || *caFile != "" || *pins != "" || *certFile != "" {
+		options := chatclient.TLSOptions{CAFile: *caFile, CertFile: *certFile, KeyFile: *keyFile}
+		if *pins != "" {
+			options.Pins = strings.Split(*pins, ",")
+		}
+		var err error
+		tlsConfig, err = chatclient.NewTLSConfig(options)
+		if err != nil {
+			log.Println("tls:", err)
+			os.Exit(1)
+		}
+	}
+
+	identityFile = *identityPath
+	baseConfig = chatclient.Config{Host: *hostName, Port: *hostPort, TLS: tlsConfig}
+
+	// Keep asking for another name until the server lets us in
+	stdin := bufio.NewReader(os.Stdin)
+	for {
+		if *login {
+			fmt.Printf("Password for %s: ", *user)
+			line, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Println()
+			if err != nil {
+				log.Println("read password:", err)
+				os.Exit(1)
+			}
+			baseConfig.Password = string(line)
+		}
+
+		var err error
+		client, err = dial(context.Background(), *user, *room)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, chatclient.ErrUnauthorized) {
+			fmt.Println("Wrong username or password.")
+			continue
+		}
+		if !chatclient.UsernameRejected(err) {
+			log.Println("join server:", err)
+			os.Exit(1)
+		}
 
-	chatWindow := tview.NewTextView().
-		SetChangedFunc(handleChangeTextView).
+		var rejection *comm.Error
+		errors.As(err, &rejection)
+		fmt.Printf("%s. Choose another username: ", rejection.Message)
+		line, err := stdin.ReadString('\n')
+		*user = strings.TrimSpace(line)
+		if err != nil || *user == "" {
+			os.Exit(1)
+		}
+	}
+	username, roomName = *user, *room
+
+	chatWindow.
 		SetScrollable(false).
 		SetDynamicColors(true)
 
+	// Show what was said before we joined. This happens before the changed
+	// func is set, since the app cannot draw until it is running.
+	lines, list := loadRoom(client)
+	for _, line := range lines {
+		fmt.Fprintf(chatWindow, "%s\n\n", line)
+	}
+	chatWindow.SetChangedFunc(handleChangeTextView)
+
+	memberList.
+		SetDynamicColors(true).
+		SetBorder(true)
+	setMembers(list)
+
 	go func() {
 		for {
 			message := <-chatChannel
 			fmt.Fprintf(chatWindow, "%s\n\n", message)
 		}
 	}()
+	go watch(client)
 
 	chatMessageInput.
-		SetPlaceholder("Send a message...").
+		SetPlaceholder("Send a message, or /help for the commands...").
 		SetPlaceholderTextColor(tcell.ColorLightGray).
 		SetPlaceholderStyle(tcell.StyleDefault.Foreground(tcell.ColorLightGray)).
 		SetFieldWidth(0).
 		SetChangedFunc(handleChangeInput).
 		SetDoneFunc(handleSendMessage).
-		SetFieldBackgroundColor(tcell.ColorBlack)
+		SetFieldBackgroundColor(tcell.ColorBlack).
+		SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+			if event.Key() == tcell.KeyTab {
+				completeInput()
+				return nil
+			}
+			return event
+		})
 
 	mainView := tview.NewGrid().
 		SetRows(0, 3).
+		SetColumns(0, 20).
 		SetBorders(false).
 		AddItem(chatWindow, 0, 0, 1, 1, 0, 0, false).
-		AddItem(chatMessageInput, 1, 0, 1, 1, 0, 0, true)
+		AddItem(memberList, 0, 1, 1, 1, 0, 0, false).
+		AddItem(chatMessageInput, 1, 0, 1, 2, 0, 0, true)
 
 	chatWindow.
 		SetBorder(true).
-		SetTitle("Go Websocket Chat Demo")
+		SetTitle(chatTitle(*room, "[green]connected[white]"))
 
 	if err := app.SetRoot(mainView, true).EnableMouse(false).Run(); err != nil {
 		panic(err)
 	}
 
 	// Close the connection when the user exits the chat
-	closeChannel <- struct{}{}
-
-	// Wait for the goroutine to finish when the user exits the chat
-	wg.Wait()
+	if client := currentClient(); client != nil {
+		client.Close()
+	}
 }
@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rivo/tview"
+)
+
+// Actions are sent as ordinary messages starting with this, so that clients
+// that do not know about them still show something sensible
+const ActionPrefix = "/me "
+
+// How long commands wait for the server to answer
+const requestTimeout = 10 * time.Second
+
+func init() {
+	Register(Command{Name: "help", Usage: "[command]", Help: "List the commands, or explain one", Run: help})
+	Register(Command{Name: "who", Help: "List the members of the room", Run: who})
+	Register(Command{Name: "me", Usage: "<action>", Help: "Say what you are doing, as in /me waves", Run: me})
+	Register(Command{Name: "msg", Usage: "<user> <message>", Help: "Send a message the server shows to user alone. It is not encrypted for them alone", Run: msg})
+}
+
+func help(call *Call) error {
+	if len(call.Args) > 0 {
+		cmd, ok := call.Registry.Lookup(call.Args[0])
+		if !ok {
+			return fmt.Errorf("there is no command %s", call.Args[0])
+		}
+		call.Print(fmt.Sprintf("[yellow]%s[white]\n%s", tview.Escape(cmd.Synopsis()), tview.Escape(cmd.Help)))
+		return nil
+	}
+
+	lines := []string{"[yellow]Commands. Tab completes them, and the names of members.[white]"}
+	for _, cmd := range call.Registry.Commands() {
+		lines = append(lines, fmt.Sprintf("%s - %s", tview.Escape(cmd.Synopsis()), tview.Escape(cmd.Help)))
+	}
+	lines = append(lines, "Start a message with // to send it with a single / in front.")
+	call.Print(strings.Join(lines, "\n"))
+	return nil
+}
+
+func who(call *Call) error {
+	if call.Client == nil {
+		return ErrNotInRoom
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	members, err := call.Client.Members(ctx)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		name := tview.Escape(member.Username)
+		if member.Operator {
+			name = "@" + name
+		}
+		if member.Idle {
+			name += " (idle)"
+		}
+		names = append(names, name)
+	}
+	call.Print(fmt.Sprintf("[gray]%d in %s: %s[white]", len(members), tview.Escape(call.Client.Room()), strings.Join(names, ", ")))
+	return nil
+}
+
+func me(call *Call) error {
+	if call.Text == "" {
+		return ErrUsage
+	}
+	if call.Client == nil {
+		return ErrNotInRoom
+	}
+	err := call.Client.Send(ActionPrefix + call.Text)
+	if err != nil {
+		return err
+	}
+	call.Print(fmt.Sprintf("* [green]You[white] %s%s", tview.Escape(call.Text), queued(call)))
+	return nil
+}
+
+func msg(call *Call) error {
+	if len(call.Args) < 2 {
+		return ErrUsage
+	}
+	if call.Client == nil {
+		return ErrNotInRoom
+	}
+	username := call.Args[0]
+	text := strings.TrimSpace(strings.TrimPrefix(call.Text, username))
+	err := call.Client.SendTo(username, text)
+	if err != nil {
+		return err
+	}
+	call.Print(fmt.Sprintf("[green]You[white] to %s [fuchsia](private)[white]: %s%s", tview.Escape(username), tview.Escape(text), queued(call)))
+	return nil
+}
+
+// queued marks messages that wait for the connection to come back
+func queued(call *Call) string {
+	if call.Client.Connected() {
+		return ""
+	}
+	return " [gray](queued)[white]"
+}
@@ -0,0 +1,154 @@
+// Package commands parses the slash commands typed into the chat client and
+// runs them. Commands are kept in a Registry. Packages can add their own to
+// Default with Register, usually from an init function.
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"websocket-chat/client/chatclient"
+
+	"github.com/rivo/tview"
+)
+
+// ErrUsage is returned by commands that were given the wrong arguments. The
+// command's usage is shown instead of the error.
+var ErrUsage = errors.New("commands: wrong arguments")
+
+// ErrNotInRoom is returned by commands that need a room when Call.Client is
+// nil
+var ErrNotInRoom = errors.New("you are not in a room, use /join <room>")
+
+// A Command is something the user can type in the message box, after a /
+type Command struct {
+	// Name without the slash, like "msg"
+	Name string
+	// Arguments shown by /help, like "<user> <message>"
+	Usage string
+	// One line description shown by /help
+	Help string
+	// Run carries out the command
+	Run func(call *Call) error
+}
+
+// A Call is one use of a command
+type Call struct {
+	// The client of the room we are in, or nil if we are in none
+	Client *chatclient.Client
+	// The words after the command, and everything after it as it was typed
+	Args []string
+	Text string
+	// Print shows line in the chat window. Lines may use tview color tags.
+	Print func(line string)
+	// The command being run, and the registry it was found in
+	Command  *Command
+	Registry *Registry
+}
+
+// A Registry holds commands by name. It is safe to use from several
+// goroutines.
+type Registry struct {
+	commands map[string]*Command
+	mu       sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]*Command)}
+}
+
+// Default is the registry the chat client reads its commands from
+var Default = NewRegistry()
+
+// Register adds cmd to Default
+func Register(cmd Command) {
+	Default.Register(cmd)
+}
+
+// Register adds cmd to the registry. Like the flag package, it panics if a
+// command by the same name is already there.
+func (r *Registry) Register(cmd Command) {
+	name := strings.ToLower(cmd.Name)
+	if name == "" || strings.ContainsAny(name, " /") || cmd.Run == nil {
+		panic(fmt.Sprintf("commands: invalid command %q", cmd.Name))
+	}
+	cmd.Name = name
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.commands[name]; ok {
+		panic(fmt.Sprintf("commands: /%s registered twice", name))
+	}
+	r.commands[name] = &cmd
+}
+
+// Lookup returns the command called name, with or without the slash
+func (r *Registry) Lookup(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.commands[strings.ToLower(strings.TrimPrefix(name, "/"))]
+	return cmd, ok
+}
+
+// Commands returns every command, sorted by name
+func (r *Registry) Commands() []*Command {
+	r.mu.RLock()
+	list := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		list = append(list, cmd)
+	}
+	r.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// IsCommand reports whether line is a command rather than a chat message.
+// Lines starting with // are messages starting with a single /, see Unescape.
+func IsCommand(line string) bool {
+	return strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "//")
+}
+
+// Unescape turns a message typed as //text into /text
+func Unescape(line string) string {
+	if strings.HasPrefix(line, "//") {
+		return line[1:]
+	}
+	return line
+}
+
+// Run parses line, which must be a command, and runs it with call. Errors are
+// printed with call.Print, so Run is meant to be started in its own
+// goroutine.
+func (r *Registry) Run(line string, call Call) {
+	name, text, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	cmd, ok := r.Lookup(name)
+	if !ok {
+		call.Print(fmt.Sprintf("[red]Unknown command /%s. Type /help to see the commands.[white]", tview.Escape(name)))
+		return
+	}
+
+	call.Text = strings.TrimSpace(text)
+	call.Args = strings.Fields(text)
+	call.Command = cmd
+	call.Registry = r
+	err := cmd.Run(&call)
+	if errors.Is(err, ErrUsage) {
+		call.Print(fmt.Sprintf("[yellow]Usage: %s[white]", tview.Escape(cmd.Synopsis())))
+		return
+	}
+	if err != nil {
+		call.Print(fmt.Sprintf("[red]/%s: %s[white]", cmd.Name, tview.Escape(err.Error())))
+	}
+}
+
+// Synopsis returns how the command is typed, like "/msg <user> <message>"
+func (cmd *Command) Synopsis() string {
+	if cmd.Usage == "" {
+		return "/" + cmd.Name
+	}
+	return "/" + cmd.Name + " " + cmd.Usage
+}
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Complete completes the last word of line, as the Tab key does. A command
+// name at the start of the line is completed from the registry, any other
+// word from names, usually the members of the room. It returns the completed
+// line, and the candidates if there is more than one to choose from.
+func (r *Registry) Complete(line string, names []string) (string, []string) {
+	if line == "" {
+		return line, nil
+	}
+	start := strings.LastIndex(line, " ") + 1
+	word := line[start:]
+
+	var candidates []string
+	if start == 0 && IsCommand(word) {
+		for _, cmd := range r.Commands() {
+			candidates = append(candidates, "/"+cmd.Name)
+		}
+	} else {
+		candidates = names
+	}
+	var matching []string
+	for _, candidate := range candidates {
+		if hasPrefixFold(candidate, word) {
+			matching = append(matching, candidate)
+		}
+	}
+	sort.Strings(matching)
+
+	switch len(matching) {
+	case 0:
+		return line, nil
+	case 1:
+		return line[:start] + matching[0] + " ", nil
+	}
+	// Get as far as all candidates agree
+	prefix := matching[0]
+	for _, candidate := range matching[1:] {
+		for !hasPrefixFold(candidate, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	if len(prefix) > len(word) {
+		line = line[:start] + prefix
+	}
+	return line, matching
+}
+
+func hasPrefixFold(s string, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
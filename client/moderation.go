@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"websocket-chat/client/commands"
+	"websocket-chat/comm"
+
+	"github.com/rivo/tview"
+)
+
+// Operator commands. The server checks that we are an operator.
+func init() {
+	commands.Register(commands.Command{Name: "kick", Usage: "<user> [reason]", Help: "Remove user from the room (operators only)", Run: moderate})
+	commands.Register(commands.Command{Name: "ban", Usage: "[-ip|-session] <user> [duration] [reason]", Help: "Keep user out of the room, by name, address or session (operators only)", Run: moderate})
+	commands.Register(commands.Command{Name: "unban", Usage: "<user>", Help: "Lift the bans on user (operators only)", Run: moderate})
+	commands.Register(commands.Command{Name: "mute", Usage: "<user> [duration] [reason]", Help: "Stop user from sending messages (operators only)", Run: moderate})
+	commands.Register(commands.Command{Name: "unmute", Usage: "<user>", Help: "Let user send messages again (operators only)", Run: moderate})
+}
+
+func moderate(call *commands.Call) error {
+	command := call.Command.Name
+	args := call.Args
+	match := comm.BanUsername
+	if command == "ban" && len(args) > 0 {
+		switch args[0] {
+		case "-ip":
+			match, args = comm.BanIP, args[1:]
+		case "-session":
+			match, args = comm.BanSession, args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return commands.ErrUsage
+	}
+	if call.Client == nil {
+		return commands.ErrNotInRoom
+	}
+	username, args := args[0], args[1:]
+	// A duration, like 10m or 2h, may come first
+	var duration time.Duration
+	if len(args) > 0 && (command == "ban" || command == "mute") {
+		parsed, err := time.ParseDuration(args[0])
+		if err == nil && parsed > 0 {
+			duration, args = parsed, args[1:]
+		}
+	}
+	reason := strings.Join(args, " ")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var result string
+	var err error
+	switch command {
+	case "kick":
+		result, err = call.Client.Kick(ctx, username, reason)
+	case "ban":
+		result, err = call.Client.Ban(ctx, username, match, duration, reason)
+	case "unban":
+		result, err = call.Client.Unban(ctx, username)
+	case "mute":
+		result, err = call.Client.Mute(ctx, username, duration, reason)
+	case "unmute":
+		result, err = call.Client.Unmute(ctx, username)
+	}
+	if err != nil {
+		return err
+	}
+	call.Print(fmt.Sprintf("[gray]%s[white]", tview.Escape(result)))
+	return nil
+}
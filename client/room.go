@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"websocket-chat/client/chatclient"
+	"websocket-chat/client/commands"
+	"websocket-chat/util"
+
+	"github.com/rivo/tview"
+)
+
+// How long /join and /nick wait to get into the room
+const joinTimeout = 30 * time.Second
+
+// The room we are in and the name we joined it with. /join, /leave and /nick
+// change them; client is nil after /leave.
+var (
+	client   *chatclient.Client
+	username string
+	roomName string
+	clientMu sync.Mutex
+)
+
+// What every connection is dialed with, apart from the username, room and
+// identity
+var (
+	baseConfig chatclient.Config
+	// Set by -identity. Otherwise each username keeps its own identity under
+	// the user config dir.
+	identityFile string
+)
+
+func init() {
+	commands.Register(commands.Command{Name: "nick", Usage: "<name>", Help: "Join the room again under another name", Run: handleNick})
+	commands.Register(commands.Command{Name: "join", Usage: "<room>", Help: "Leave this room for another one", Run: handleJoin})
+	commands.Register(commands.Command{Name: "leave", Help: "Leave the room", Run: handleLeave})
+	commands.Register(commands.Command{Name: "clear", Help: "Clear the chat window", Run: func(call *commands.Call) error {
+		app.QueueUpdateDraw(func() {
+			chatWindow.Clear()
+		})
+		return nil
+	}})
+	commands.Register(commands.Command{Name: "quit", Help: "Leave the room and close the chat", Run: func(call *commands.Call) error {
+		app.Stop()
+		return nil
+	}})
+}
+
+func currentClient() *chatclient.Client {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	return client
+}
+
+// dial joins room as name, with the identity and known peers kept for name
+func dial(ctx context.Context, name string, room string) (*chatclient.Client, error) {
+	path := identityFile
+	if path == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			configDir = "."
+		}
+		path = filepath.Join(configDir, "websocket-chat", name, "identity.pem")
+	}
+	identity, err := util.LoadOrCreateIdentity(path)
+	if err != nil {
+		return nil, errors.New("Error loading identity: " + err.Error())
+	}
+	// Known peers are kept next to the identity they were verified with
+	trustStore, err := chatclient.LoadTrustStore(filepath.Join(filepath.Dir(path), "known_peers.json"))
+	if err != nil {
+		return nil, errors.New("Error loading known peers: " + err.Error())
+	}
+
+	cfg := baseConfig
+	cfg.Username = name
+	cfg.Room = room
+	cfg.Identity = identity
+	cfg.TrustStore = trustStore
+	return chatclient.Dial(ctx, cfg)
+}
+
+// loadRoom fetches what was said in client's room before we joined and who
+// is there, as lines for the chat window and the member list
+func loadRoom(client *chatclient.Client) ([]string, []chatclient.Member) {
+	var lines []string
+	history, err := client.History(context.Background(), historyLength)
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("[red]%s[white]", tview.Escape(err.Error())))
+	}
+	for _, event := range history {
+		if line := formatEvent(client, event); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	list, err := client.Members(context.Background())
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("[red]%s[white]", tview.Escape(err.Error())))
+	}
+	return lines, list
+}
+
+// watch shows client's events until it is closed. Once another client has
+// taken its place, what is left is thrown away.
+func watch(client *chatclient.Client) {
+	for event := range client.Messages() {
+		if client != currentClient() {
+			continue
+		}
+		if status := connectionStatus(event); status != "" {
+			app.QueueUpdateDraw(func() {
+				chatWindow.SetTitle(chatTitle(client.Room(), status))
+			})
+		}
+		switch event.Type {
+		case chatclient.Presence:
+			app.QueueUpdateDraw(func() {
+				if client == currentClient() {
+					updateMembers(event)
+				}
+			})
+		case chatclient.Reconnected:
+			// Presence events were missed while we were away
+			go refreshMembers(client)
+		}
+		if line := formatEvent(client, event); line != "" {
+			chatChannel <- line
+		}
+	}
+}
+
+// switchRoom joins room as name and then leaves the room we were in, so that
+// we stay where we are if joining fails. If room is empty, it only leaves.
+func switchRoom(name string, room string) error {
+	var next *chatclient.Client
+	if room != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), joinTimeout)
+		defer cancel()
+		var err error
+		next, err = dial(ctx, name, room)
+		if err != nil {
+			return err
+		}
+	}
+
+	clientMu.Lock()
+	previous := client
+	client, username, roomName = next, name, room
+	clientMu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	if next == nil {
+		app.QueueUpdateDraw(func() {
+			setMembers(nil)
+			chatWindow.SetTitle(chatTitle("no room", "[gray]not connected[white]"))
+		})
+		return nil
+	}
+	lines, list := loadRoom(next)
+	app.QueueUpdateDraw(func() {
+		if next == currentClient() {
+			setMembers(list)
+			chatWindow.SetTitle(chatTitle(room, "[green]connected[white]"))
+		}
+	})
+	chatChannel <- fmt.Sprintf("[yellow]You are in %s as %s[white]", tview.Escape(room), tview.Escape(name))
+	for _, line := range lines {
+		chatChannel <- line
+	}
+	go watch(next)
+	return nil
+}
+
+func handleNick(call *commands.Call) error {
+	if len(call.Args) != 1 {
+		return commands.ErrUsage
+	}
+	name := call.Args[0]
+	clientMu.Lock()
+	current, room, inRoom := username, roomName, client != nil
+	clientMu.Unlock()
+	if baseConfig.Password != "" {
+		return fmt.Errorf("you are logged in as %s, restart with -username to use another account", current)
+	}
+	if name == current {
+		return fmt.Errorf("you are %s already", name)
+	}
+	if !inRoom {
+		clientMu.Lock()
+		username = name
+		clientMu.Unlock()
+		call.Print(fmt.Sprintf("[gray]You will join the next room as %s[white]", tview.Escape(name)))
+		return nil
+	}
+	call.Print(fmt.Sprintf("[gray]Joining %s again as %s...[white]", tview.Escape(room), tview.Escape(name)))
+	return switchRoom(name, room)
+}
+
+func handleJoin(call *commands.Call) error {
+	if len(call.Args) != 1 {
+		return commands.ErrUsage
+	}
+	room := call.Args[0]
+	clientMu.Lock()
+	name, current, inRoom := username, roomName, client != nil
+	clientMu.Unlock()
+	if inRoom && room == current {
+		return fmt.Errorf("you are in %s already", room)
+	}
+	call.Print(fmt.Sprintf("[gray]Joining %s...[white]", tview.Escape(room)))
+	return switchRoom(name, room)
+}
+
+func handleLeave(call *commands.Call) error {
+	clientMu.Lock()
+	name, room, inRoom := username, roomName, client != nil
+	clientMu.Unlock()
+	if !inRoom {
+		return commands.ErrNotInRoom
+	}
+	err := switchRoom(name, "")
+	if err != nil {
+		return err
+	}
+	call.Print(fmt.Sprintf("[gray]You left %s. Use /join <room> to enter another one.[white]", tview.Escape(room)))
+	return nil
+}
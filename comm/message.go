@@ -1,56 +1,501 @@
+// Package comm defines the chat wire protocol. Every JSON frame is an
+// Envelope carrying the protocol version, the kind of message and its typed
+// payload.
 package comm
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"websocket-chat/util"
 )
 
-type Message struct {
-	Username string `json:"username"`
-	Message  string `json:"message"`
-	Type     int    `json:"messageType"`
-	Data     []byte `json:"data"`
+// ProtocolVersion is the newest version this build speaks. Clients list the
+// versions they support when joining and the server picks the highest one
+// both sides know. Version 1 used separate /connect and /key-exchange
+// connections and is no longer supported.
+const ProtocolVersion = 2
+
+var SupportedVersions = []int{ProtocolVersion}
+
+// Websocket subprotocol clients ask for when opening /ws. The protocol
+// version itself is still negotiated in Join.
+const Subprotocol = "websocket-chat.v2"
+
+// Clients that do not name a room in their join message end up here
+const DefaultRoom = "general"
+
+type Kind string
+
+const (
+	// Client to server
+	KindJoin Kind = "join"
+	// Server to client, in reply to a join
+	KindJoinAccepted Kind = "join-accepted"
+	// Both directions
+	KindText      Kind = "text"
+	KindIdentity  Kind = "identity"
+	KindSenderKey Kind = "sender-key"
+	// Server to key hub
+	KindGenerateKeys Kind = "generate-keys"
+	KindExchangeKeys Kind = "exchange-keys"
+	// Key exchange between the key hub and a member, relayed by the server
+	KindKeyOffer  Kind = "key-offer"
+	KindKeyAccept Kind = "key-accept"
+	KindRoomKey   Kind = "room-key"
+	// Client to server, answered with a HistoryResult
+	KindHistory       Kind = "history"
+	KindHistoryResult Kind = "history-result"
+	// Server to members
+	KindPresence Kind = "presence"
+	KindNotice   Kind = "notice"
+	KindShutdown Kind = "shutdown"
+	// Client to server, answered with Members
+	KindWho     Kind = "who"
+	KindMembers Kind = "members"
+	// Operator to server, answered with Moderated
+	KindModerate  Kind = "moderate"
+	KindModerated Kind = "moderated"
+	// Server to a member that is being removed from the room
+	KindKicked Kind = "kicked"
+
+	KindError Kind = "error"
+)
+
+// Error codes sent in Error frames
+const (
+	ErrCodeUnknownKind        = "unknown-kind"
+	ErrCodeUnsupportedVersion = "unsupported-version"
+	ErrCodeBadRequest         = "bad-request"
+	ErrCodeNotMember          = "not-member"
+	ErrCodeKeyExchangeFailed  = "key-exchange-failed"
+	ErrCodeInternal           = "internal"
+	// The join was rejected because someone in the room already uses the
+	// username, because the server keeps it for itself, or because it is too
+	// long or has characters usernames may not have
+	ErrCodeUsernameTaken    = "username-taken"
+	ErrCodeUsernameReserved = "username-reserved"
+	ErrCodeUsernameInvalid  = "username-invalid"
+	// The join names a different user than the one the client logged in as
+	ErrCodeUnauthorized = "unauthorized"
+	// The server only has a fixed set of rooms and this is not one of them
+	ErrCodeNoSuchRoom = "no-such-room"
+	// Joining would create a room, but the server has as many as it allows
+	ErrCodeTooManyRooms = "too-many-rooms"
+	// A chat message was dropped because the client sends too fast, or
+	// because it was muted for doing so
+	ErrCodeRateLimited = "rate-limited"
+	ErrCodeMuted       = "muted"
+	// A chat message was dropped for being longer than the server allows
+	ErrCodeMessageTooLong = "message-too-long"
+	// Only room operators may moderate, and operators cannot be moderated
+	ErrCodeForbidden = "forbidden"
+	// Nobody by that name is in the room, or banned from it
+	ErrCodeNoSuchUser = "no-such-user"
+	// The join was rejected because the client is banned from the room
+	ErrCodeBanned = "banned"
+)
+
+var (
+	ErrUnknownKind        = errors.New("unknown message kind")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+type Envelope struct {
+	Version int  `json:"v"`
+	Kind    Kind `json:"kind"`
+	// Correlates the frames of one request: a reply carries the id of the
+	// request it answers, and every frame of a key exchange carries the id
+	// the server gave the exchange
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
-func (msg Message) String() string {
-	if msg.Type == Text {
-		return fmt.Sprintf("%s: %s", msg.Username, msg.Message)
+// A Message is the typed payload of an envelope
+type Message interface {
+	Kind() Kind
+}
+
+var kinds = map[Kind]func() Message{
+	KindJoin:          func() Message { return &Join{} },
+	KindJoinAccepted:  func() Message { return &JoinAccepted{} },
+	KindText:          func() Message { return &Text{} },
+	KindIdentity:      func() Message { return &Identity{} },
+	KindSenderKey:     func() Message { return &SenderKey{} },
+	KindGenerateKeys:  func() Message { return &GenerateKeys{} },
+	KindExchangeKeys:  func() Message { return &ExchangeKeys{} },
+	KindKeyOffer:      func() Message { return &KeyOffer{} },
+	KindKeyAccept:     func() Message { return &KeyAccept{} },
+	KindRoomKey:       func() Message { return &RoomKey{} },
+	KindHistory:       func() Message { return &History{} },
+	KindHistoryResult: func() Message { return &HistoryResult{} },
+	KindPresence:      func() Message { return &Presence{} },
+	KindNotice:        func() Message { return &Notice{} },
+	KindShutdown:      func() Message { return &Shutdown{} },
+	KindWho:           func() Message { return &Who{} },
+	KindMembers:       func() Message { return &Members{} },
+	KindModerate:      func() Message { return &Moderate{} },
+	KindModerated:     func() Message { return &Moderated{} },
+	KindKicked:        func() Message { return &Kicked{} },
+	KindError:         func() Message { return &Error{} },
+}
+
+func IsSupportedVersion(version int) bool {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return true
+		}
 	}
-	return fmt.Sprintf("{%s %s %d %s}", msg.Username, msg.Message, msg.Type, msg.Data)
+	return false
 }
 
-func (msg *Message) Print() error {
-	key := util.GetRoomKey()
-	decryptedBytes, err := util.Decrypt(msg.Message, key)
-	if err != nil {
-		return err
+// NegotiateVersion picks the newest version in offered that we also support
+func NegotiateVersion(offered []int) (int, bool) {
+	best := 0
+	for _, version := range offered {
+		if IsSupportedVersion(version) && version > best {
+			best = version
+		}
 	}
-	decryptedMessage := string(decryptedBytes)
-	fmt.Printf("%s: %s\n", msg.Username, decryptedMessage)
-	return nil
+	return best, best != 0
 }
 
-func (msg *Message) GetDecryptedMessage() (string, error) {
-	key := util.GetRoomKey()
-	decryptedBytes, err := util.Decrypt(msg.Message, key)
+func Encode(version int, id string, msg Message) (Envelope, error) {
+	payload, err := json.Marshal(msg)
 	if err != nil {
-		return "", err
+		return Envelope{}, err
 	}
-	decryptedMessage := string(decryptedBytes)
+	return Envelope{Version: version, Kind: msg.Kind(), Id: id, Payload: payload}, nil
+}
+
+// Decode returns a pointer to the typed payload of env, such as *Text.
+func Decode(env *Envelope) (Message, error) {
+	if !IsSupportedVersion(env.Version) {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, env.Version)
+	}
+	newMessage, ok := kinds[env.Kind]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKind, env.Kind)
+	}
+
+	msg := newMessage()
+	if len(env.Payload) > 0 {
+		err := json.Unmarshal(env.Payload, msg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s payload: %w", env.Kind, err)
+		}
+	}
+	return msg, nil
+}
+
+// ErrorFor builds the error frame that rejects a frame Decode failed on
+func ErrorFor(err error) *Error {
+	switch {
+	case errors.Is(err, ErrUnknownKind):
+		return &Error{Code: ErrCodeUnknownKind, Message: err.Error()}
+	case errors.Is(err, ErrUnsupportedVersion):
+		return &Error{Code: ErrCodeUnsupportedVersion, Message: err.Error()}
+	}
+	return &Error{Code: ErrCodeBadRequest, Message: err.Error()}
+}
+
+// Login is posted as plain JSON to /login on servers that require accounts.
+// It is answered with a LoginResult. Neither is sent in an Envelope.
+type Login struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginResult carries the token to send as "Authorization: Bearer <token>"
+// when opening /ws
+type LoginResult struct {
+	Token string `json:"token"`
+	// When the token stops being accepted, in Unix seconds
+	Expires int64 `json:"expires"`
+}
+
+// Join is the first message on /ws
+type Join struct {
+	Username string `json:"username"`
+	Room     string `json:"room,omitempty"`
+	// Protocol versions the client can speak
+	Versions []int `json:"versions"`
+	// Stays the same when a client reconnects, so the server can resume its
+	// membership
+	Session string `json:"session,omitempty"`
+	// Room key epoch the client already holds, if it is reconnecting
+	Epoch uint64 `json:"epoch,omitempty"`
+}
+
+// JoinAccepted answers a Join. If KeyHub and Resumed are false, a key
+// exchange with the key hub follows before the client is a member of the
+// room.
+type JoinAccepted struct {
+	Version int  `json:"version"`
+	KeyHub  bool `json:"keyHub"`
+	// The client reconnected before its session expired and still holds the
+	// current room key, so it is a member again right away
+	Resumed bool `json:"resumed,omitempty"`
+}
+
+type Text struct {
+	Username   string `json:"username"`
+	Ciphertext string `json:"ciphertext"`
+	// Index of the message key in the sender's chain, authenticated along
+	// with the ciphertext
+	Seq uint64 `json:"seq"`
+	// Which room key epoch the sender's chain belongs to. The room key is
+	// rotated whenever someone leaves, and each rotation starts a new epoch.
+	Epoch uint64 `json:"epoch"`
+	// Set on private messages, which the server only passes on to the member
+	// named here and does not keep in the history. They are encrypted with
+	// the sender's chain like any other message, so this only hides them
+	// from the other members as long as the server does what it is told.
+	// It is authenticated along with the ciphertext, so the server cannot
+	// make a private message look like one to the whole room.
+	To string `json:"to,omitempty"`
+}
+
+// Identity announces a member's signed identity key to the room
+type Identity struct {
+	Username  string         `json:"username"`
+	SignedKey util.SignedKey `json:"signedKey"`
+}
+
+// SenderKey hands a member's sender chain to the room, encrypted with the
+// room key of Epoch
+type SenderKey struct {
+	Username   string `json:"username"`
+	Ciphertext string `json:"ciphertext"`
+	Epoch      uint64 `json:"epoch"`
+	// Random id of the chain, the same every time it is announced, so the
+	// server only keeps its first announcement in the history
+	Chain string `json:"chain,omitempty"`
+}
+
+// GenerateKeys tells the key hub to create the room key for Epoch
+type GenerateKeys struct {
+	Epoch uint64 `json:"epoch"`
+}
+
+// ExchangeKeys asks the key hub to hand the room key to Username. The
+// envelope id names the exchange, and the key hub answers with a KeyOffer
+// carrying the same id.
+type ExchangeKeys struct {
+	Username string `json:"username"`
+}
+
+// KeyOffer carries the key hub's signed ephemeral key to the member
+type KeyOffer struct {
+	SignedKey util.SignedKey `json:"signedKey"`
+}
+
+// KeyAccept carries the member's signed ephemeral key back to the key hub
+type KeyAccept struct {
+	SignedKey util.SignedKey `json:"signedKey"`
+}
 
-	message := fmt.Sprintf("%s: %s", msg.Username, decryptedMessage)
-	return message, nil
+// RoomKey is the room key, wrapped with the key both sides derived from
+// their ephemeral keys
+type RoomKey struct {
+	Ciphertext string `json:"ciphertext"`
 }
 
+// History asks for up to Limit of the room's most recent messages. The server
+// picks a default if Limit is 0.
+type History struct {
+	Limit int `json:"limit,omitempty"`
+}
+
+// HistoryResult answers a History request with the stored envelopes, oldest
+// first. They are still encrypted, so a client can only read those from
+// epochs it has the room key for.
+type HistoryResult struct {
+	Messages []Envelope `json:"messages"`
+}
+
+type PresenceStatus string
+
 const (
-	Text = iota
-	Command
-	Info
+	PresenceJoined PresenceStatus = "joined"
+	PresenceLeft   PresenceStatus = "left"
+	// The member has not sent anything for a while
+	PresenceIdle PresenceStatus = "idle"
+	// The member is back from being idle
+	PresenceActive PresenceStatus = "active"
 )
 
-// Valid command names
+// Presence tells the room that a member joined, left, went idle or came back
+type Presence struct {
+	Username string         `json:"username"`
+	Status   PresenceStatus `json:"status"`
+	Operator bool           `json:"operator,omitempty"`
+}
+
+// Notice is a message from the server itself, such as the message of the day
+type Notice struct {
+	Text string `json:"text"`
+}
+
+// Shutdown tells clients the server is going away. The connection is closed
+// right after, and clients should try to reconnect later.
+type Shutdown struct {
+	Message string `json:"message"`
+}
+
+// Who asks for the room's member list
+type Who struct{}
+
+type Member struct {
+	Username string `json:"username"`
+	Idle     bool   `json:"idle,omitempty"`
+	Operator bool   `json:"operator,omitempty"`
+}
+
+// Members answers a Who request, sorted by username
+type Members struct {
+	Members []Member `json:"members"`
+}
+
+type ModerationAction string
+
+const (
+	ActionKick   ModerationAction = "kick"
+	ActionBan    ModerationAction = "ban"
+	ActionUnban  ModerationAction = "unban"
+	ActionMute   ModerationAction = "mute"
+	ActionUnmute ModerationAction = "unmute"
+)
+
+// What a ban matches joining clients on
+type BanMatch string
+
 const (
-	ExchangeKeys = iota
-	ShareRoomKey
-	GenerateKeys
+	BanUsername BanMatch = "username"
+	// The session id the member joined with
+	BanSession BanMatch = "session"
+	// The address the member connected from
+	BanIP BanMatch = "ip"
 )
+
+// Moderate asks the server to act on a member of the room. Only the room's
+// operators may send it.
+type Moderate struct {
+	Action   ModerationAction `json:"action"`
+	Username string           `json:"username"`
+	// What a ban matches on, the username unless set. Session and IP bans
+	// are taken from the member's current connection.
+	Match BanMatch `json:"match,omitempty"`
+	// How long a ban or mute lasts, in seconds, or 0 until it is lifted
+	Duration int64  `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Moderated confirms a Moderate request
+type Moderated struct {
+	Text string `json:"text"`
+}
+
+// Kicked tells a member that an operator removed it from the room. The
+// connection is closed right after, and the client should not reconnect on
+// its own.
+type Kicked struct {
+	By     string `json:"by"`
+	Reason string `json:"reason,omitempty"`
+	Banned bool   `json:"banned,omitempty"`
+	// When the ban ends, in Unix seconds, or 0 if it does not
+	Until int64 `json:"until,omitempty"`
+}
+
+// Error reports a rejected request
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (Join) Kind() Kind          { return KindJoin }
+func (JoinAccepted) Kind() Kind  { return KindJoinAccepted }
+func (Text) Kind() Kind          { return KindText }
+func (Identity) Kind() Kind      { return KindIdentity }
+func (SenderKey) Kind() Kind     { return KindSenderKey }
+func (GenerateKeys) Kind() Kind  { return KindGenerateKeys }
+func (ExchangeKeys) Kind() Kind  { return KindExchangeKeys }
+func (KeyOffer) Kind() Kind      { return KindKeyOffer }
+func (KeyAccept) Kind() Kind     { return KindKeyAccept }
+func (RoomKey) Kind() Kind       { return KindRoomKey }
+func (History) Kind() Kind       { return KindHistory }
+func (HistoryResult) Kind() Kind { return KindHistoryResult }
+func (Presence) Kind() Kind      { return KindPresence }
+func (Notice) Kind() Kind        { return KindNotice }
+func (Shutdown) Kind() Kind      { return KindShutdown }
+func (Who) Kind() Kind           { return KindWho }
+func (Members) Kind() Kind       { return KindMembers }
+func (Moderate) Kind() Kind      { return KindModerate }
+func (Moderated) Kind() Kind     { return KindModerated }
+func (Kicked) Kind() Kind        { return KindKicked }
+func (Error) Kind() Kind         { return KindError }
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// additionalData is the associated data that binds a ciphertext to its kind,
+// sender, chain index and key epoch
+func additionalData(kind Kind, username string, seq uint64, epoch uint64) []byte {
+	data := make([]byte, 0, len(util.SealVersion)+len(kind)+len(username)+32)
+	data = append(data, util.SealVersion...)
+	data = binary.BigEndian.AppendUint64(data, uint64(len(kind)))
+	data = append(data, kind...)
+	data = binary.BigEndian.AppendUint64(data, seq)
+	data = binary.BigEndian.AppendUint64(data, epoch)
+	data = binary.BigEndian.AppendUint64(data, uint64(len(username)))
+	data = append(data, username...)
+	return data
+}
+
+func (msg *Text) AdditionalData() []byte {
+	data := additionalData(KindText, msg.Username, msg.Seq, msg.Epoch)
+	if msg.To != "" {
+		data = binary.BigEndian.AppendUint64(data, uint64(len(msg.To)))
+		data = append(data, msg.To...)
+	}
+	return data
+}
+
+// Encrypt seals plaintext into msg.Ciphertext. Username, Seq, Epoch and To
+// must be set beforehand since they are authenticated along with it.
+func (msg *Text) Encrypt(plaintext []byte, key []byte) error {
+	ciphertext, err := util.Seal(plaintext, key, msg.AdditionalData())
+	if err != nil {
+		return err
+	}
+	msg.Ciphertext = ciphertext
+	return nil
+}
+
+func (msg *Text) Decrypt(key []byte) ([]byte, error) {
+	return util.Open(msg.Ciphertext, key, msg.AdditionalData())
+}
+
+func (msg *SenderKey) AdditionalData() []byte {
+	data := additionalData(KindSenderKey, msg.Username, 0, msg.Epoch)
+	if msg.Chain != "" {
+		data = binary.BigEndian.AppendUint64(data, uint64(len(msg.Chain)))
+		data = append(data, msg.Chain...)
+	}
+	return data
+}
+
+func (msg *SenderKey) Encrypt(plaintext []byte, key []byte) error {
+	ciphertext, err := util.Seal(plaintext, key, msg.AdditionalData())
+	if err != nil {
+		return err
+	}
+	msg.Ciphertext = ciphertext
+	return nil
+}
+
+func (msg *SenderKey) Decrypt(key []byte) ([]byte, error) {
+	return util.Open(msg.Ciphertext, key, msg.AdditionalData())
+}
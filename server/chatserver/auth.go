@@ -0,0 +1,124 @@
+package chatserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"websocket-chat/comm"
+)
+
+// How long a login token is accepted when Options.TokenLifetime is not set
+const defaultTokenLifetime = 24 * time.Hour
+
+var (
+	ErrInvalidCredentials = errors.New("chatserver: invalid username or password")
+	errInvalidToken       = errors.New("invalid token")
+	errTokenExpired       = errors.New("token expired")
+)
+
+// An Authenticator checks a user's password. It returns
+// ErrInvalidCredentials if the user does not exist or the password is wrong.
+type Authenticator interface {
+	Authenticate(username string, password string) error
+}
+
+type tokenClaims struct {
+	Username string `json:"u"`
+	Expires  int64  `json:"exp"`
+}
+
+// signToken issues a token for username. A token is its claims and their
+// HMAC, each base64 encoded and joined with a dot.
+func (s *Server) signToken(username string, expires time.Time) (string, error) {
+	claims, err := json.Marshal(tokenClaims{Username: username, Expires: expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.tokenMAC(payload)), nil
+}
+
+func (s *Server) tokenMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, s.tokenKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// verifyToken returns the user a token was issued to
+func (s *Server) verifyToken(token string) (string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.tokenMAC(payload)) {
+		return "", errInvalidToken
+	}
+
+	claims, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	var parsed tokenClaims
+	err = json.Unmarshal(claims, &parsed)
+	if err != nil || parsed.Username == "" {
+		return "", errInvalidToken
+	}
+	if time.Now().Unix() >= parsed.Expires {
+		return "", errTokenExpired
+	}
+	return parsed.Username, nil
+}
+
+// authenticate returns the user an upgrade request was made for, from the
+// token in its Authorization header
+func (s *Server) authenticate(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", errors.New("missing token")
+	}
+	return s.verifyToken(token)
+}
+
+// handleLogin checks a user's password and hands out a token for /ws
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Authenticator == nil {
+		http.Error(w, "this server does not use accounts", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var login comm.Login
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&login)
+	if err != nil {
+		http.Error(w, "invalid login request", http.StatusBadRequest)
+		return
+	}
+	err = s.opts.Authenticator.Authenticate(login.Username, login.Password)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) {
+			s.log.Println("login:", err)
+		}
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	expires := time.Now().Add(s.options().TokenLifetime)
+	token, err := s.signToken(login.Username, expires)
+	if err != nil {
+		s.log.Println("login:", err)
+		http.Error(w, "could not log in", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comm.LoginResult{Token: token, Expires: expires.Unix()})
+}
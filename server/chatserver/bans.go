@@ -0,0 +1,148 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"websocket-chat/comm"
+)
+
+// A Ban keeps matching clients out of a room
+type Ban struct {
+	Room  string        `json:"room"`
+	Match comm.BanMatch `json:"match"`
+	// The username, session id or IP address the ban matches
+	Value string `json:"value"`
+	// Who was banned and by whom, so the ban can be lifted by name
+	Username string `json:"username"`
+	By       string `json:"by"`
+	Reason   string `json:"reason,omitempty"`
+	// When the ban ends, or zero if it does not
+	Until time.Time `json:"until,omitzero"`
+}
+
+func (ban *Ban) expired(now time.Time) bool {
+	return !ban.Until.IsZero() && now.After(ban.Until)
+}
+
+// matches reports whether a client joining with username, session and ip is
+// banned
+func (ban *Ban) matches(username string, session string, ip string) bool {
+	switch ban.Match {
+	case comm.BanSession:
+		return session != "" && ban.Value == session
+	case comm.BanIP:
+		return ip != "" && ban.Value == ip
+	}
+	return strings.EqualFold(ban.Value, username)
+}
+
+// A BanList keeps the bans of every room
+type BanList interface {
+	Add(ban Ban) error
+	// Remove lifts every ban of username in room and returns how many there
+	// were
+	Remove(room string, username string) (int, error)
+	// Find returns the ban in room that keeps out a client joining with
+	// username, session and ip, or nil if there is none
+	Find(room string, username string, session string, ip string) (*Ban, error)
+}
+
+// FileBanList is a BanList kept in a JSON file. Expired bans are dropped
+// whenever the file is written.
+type FileBanList struct {
+	path string
+	bans []Ban
+	mu   sync.Mutex
+}
+
+// NewFileBanList loads the bans in path. A missing file is treated as an
+// empty list. If path is empty, the bans are only kept in memory.
+func NewFileBanList(path string) (*FileBanList, error) {
+	list := &FileBanList{path: path}
+	if path == "" {
+		return list, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, errors.New("Error opening ban list: " + err.Error())
+	}
+	err = json.Unmarshal(data, &list.bans)
+	if err != nil {
+		return nil, errors.New("Error reading ban list: " + err.Error())
+	}
+	return list, nil
+}
+
+func (list *FileBanList) Add(ban Ban) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.bans = append(list.bans, ban)
+	return list.save()
+}
+
+func (list *FileBanList) Remove(room string, username string) (int, error) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	kept := list.bans[:0]
+	removed := 0
+	for _, ban := range list.bans {
+		if ban.Room == room && strings.EqualFold(ban.Username, username) {
+			removed++
+			continue
+		}
+		kept = append(kept, ban)
+	}
+	list.bans = kept
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, list.save()
+}
+
+func (list *FileBanList) Find(room string, username string, session string, ip string) (*Ban, error) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	now := time.Now()
+	for _, ban := range list.bans {
+		if ban.Room == room && !ban.expired(now) && ban.matches(username, session, ip) {
+			return &ban, nil
+		}
+	}
+	return nil, nil
+}
+
+// save must be called with list.mu held
+func (list *FileBanList) save() error {
+	now := time.Now()
+	kept := list.bans[:0]
+	for _, ban := range list.bans {
+		if !ban.expired(now) {
+			kept = append(kept, ban)
+		}
+	}
+	list.bans = kept
+	if list.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(list.bans, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = atomicWriteFile(list.path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return errors.New("Error saving ban list: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package chatserver
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// atomicWriteFile replaces the file at path with what write writes. The new
+// contents go to a temporary file that is renamed over path once it is synced,
+// so a crash leaves either the old file or the new one, never half of one.
+func atomicWriteFile(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	temp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if err == nil {
+		err = temp.Close()
+	} else {
+		temp.Close()
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The rename itself is only durable once the directory is synced
+	parent, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = parent.Sync()
+	parent.Close()
+	return err
+}
@@ -0,0 +1,136 @@
+package chatserver
+
+import (
+	"errors"
+	"time"
+	"websocket-chat/comm"
+	serverclient "websocket-chat/server/serverClient"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// How long a member waits for the key hub to hand it the room key
+const keyExchangeTimeout = 30 * time.Second
+
+// errExchangeCancelled is returned for frames of an exchange the sender took
+// part in, but which was called off
+var errExchangeCancelled = errors.New("key exchange was cancelled")
+
+// A keyExchange hands the room key from the key hub to one member. Every
+// frame of the exchange carries its id, so a frame can never end up with
+// another member's exchange.
+//
+// The key hub and the member each generate an ephemeral X25519 key pair. We
+// only relay the public keys and the wrapped room key, so we never learn the
+// room key ourselves.
+type keyExchange struct {
+	id     string
+	keyHub *serverclient.Client
+	member *serverclient.Client
+	timer  *time.Timer
+}
+
+// startKeyExchange asks the key hub to hand the room key to member, unless
+// the member left in the meantime
+func (room *Room) startKeyExchange(member *serverclient.Client) {
+	room.mu.Lock()
+	if room.keyHub == nil || room.keyHub == member || !room.clients[member] && !room.joining[member] {
+		room.mu.Unlock()
+		return
+	}
+	exchange := &keyExchange{id: uuid.New().String(), keyHub: room.keyHub, member: member}
+	exchange.timer = time.AfterFunc(keyExchangeTimeout, func() {
+		room.expireKeyExchange(exchange)
+	})
+	room.exchanges[exchange.id] = exchange
+	room.mu.Unlock()
+
+	room.send(MessageEvent{id: exchange.id, message: &comm.ExchangeKeys{Username: member.Username}, recipient: exchange.keyHub})
+}
+
+// relayKeyExchange passes one frame of an exchange on to the other side. The
+// key hub sends the offer and the wrapped room key, the member sends its
+// accept. Once the room key has been passed on, the member is admitted to the
+// room.
+func (room *Room) relayKeyExchange(sender *serverclient.Client, id string, msg comm.Message) error {
+	room.mu.Lock()
+	exchange, ok := room.exchanges[id]
+	if !ok {
+		cancelled := room.cancelled[id]
+		room.mu.Unlock()
+		if cancelled != nil && (sender == cancelled.keyHub || sender == cancelled.member) {
+			return errExchangeCancelled
+		}
+		return errors.New("no key exchange with id " + id)
+	}
+
+	var recipient *serverclient.Client
+	done := false
+	switch msg.(type) {
+	case *comm.KeyOffer:
+		if sender == exchange.keyHub {
+			recipient = exchange.member
+		}
+	case *comm.KeyAccept:
+		if sender == exchange.member {
+			recipient = exchange.keyHub
+		}
+	case *comm.RoomKey:
+		if sender == exchange.keyHub {
+			recipient = exchange.member
+			done = true
+			exchange.timer.Stop()
+			delete(room.exchanges, id)
+		}
+	}
+	room.mu.Unlock()
+
+	if recipient == nil {
+		return errors.New("not part of key exchange " + id)
+	}
+	room.send(MessageEvent{id: id, message: msg, recipient: recipient})
+	if done {
+		room.admit(exchange.member)
+	}
+	return nil
+}
+
+// cancelKeyExchanges drops every exchange client takes part in. Must be
+// called with room.mu held.
+func (room *Room) cancelKeyExchanges(client *serverclient.Client) {
+	for _, exchange := range room.exchanges {
+		if exchange.keyHub == client || exchange.member == client {
+			exchange.timer.Stop()
+			room.cancelKeyExchange(exchange)
+		}
+	}
+}
+
+// cancelKeyExchange drops an exchange, but remembers it for as long as an
+// exchange may take. Must be called with room.mu held.
+func (room *Room) cancelKeyExchange(exchange *keyExchange) {
+	delete(room.exchanges, exchange.id)
+	room.cancelled[exchange.id] = exchange
+	time.AfterFunc(keyExchangeTimeout, func() {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		delete(room.cancelled, exchange.id)
+	})
+}
+
+func (room *Room) expireKeyExchange(exchange *keyExchange) {
+	room.mu.Lock()
+	_, ok := room.exchanges[exchange.id]
+	if ok {
+		room.cancelKeyExchange(exchange)
+	}
+	room.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	room.server.log.Println("key exchange timed out for", exchange.member.Username)
+	exchange.member.SendError(exchange.id, comm.ErrCodeKeyExchangeFailed, "key exchange timed out")
+	exchange.member.Close(websocket.ClosePolicyViolation, "key exchange timed out")
+}
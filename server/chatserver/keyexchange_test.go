@@ -0,0 +1,56 @@
+package chatserver
+
+import (
+	"context"
+	"testing"
+	"time"
+	"websocket-chat/client/chatclient"
+	"websocket-chat/util"
+)
+
+func TestKeyHubRefusesChangedIdentity(t *testing.T) {
+	_, cfg := startServer(t, Options{})
+
+	// Alice verified a Bob whose identity key is not the one joining now
+	trust, err := chatclient.LoadTrustStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := util.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = trust.Verify("bob", other.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceCfg := cfg
+	aliceCfg.TrustStore = trust
+	alice, err := dial(t, aliceCfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warned := make(chan bool, 1)
+	go func() {
+		for event := range alice.Messages() {
+			if event.Type == chatclient.IdentityNotice && event.Username == "bob" && event.Trust == chatclient.Changed {
+				warned <- true
+				return
+			}
+		}
+	}()
+
+	cfg.Username = "bob"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	bob, err := chatclient.Dial(ctx, cfg)
+	if err == nil {
+		bob.Close()
+		t.Fatal("bob got the room key with a changed identity key")
+	}
+	select {
+	case <-warned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("alice was not warned about bob's identity key")
+	}
+}
@@ -0,0 +1,256 @@
+package chatserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"websocket-chat/comm"
+	serverclient "websocket-chat/server/serverClient"
+
+	"github.com/gorilla/websocket"
+)
+
+// isOperator reports whether username may moderate room
+func (s *Server) isOperator(room string, username string) bool {
+	operators := s.options().Operators
+	for _, list := range [][]string{operators[room], operators["*"]} {
+		for _, operator := range list {
+			if strings.EqualFold(operator, username) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkBan returns why client may not join room, or "" if it may. Operators
+// are never banned, or banning an address they share with others could
+// lock out everyone able to lift the ban.
+func (s *Server) checkBan(room string, client *serverclient.Client) (string, error) {
+	if s.isOperator(room, client.Username) {
+		return "", nil
+	}
+	ban, err := s.opts.Bans.Find(room, client.Username, client.Session, client.Addr)
+	if err != nil || ban == nil {
+		return "", err
+	}
+	reason := fmt.Sprintf("banned from %s by %s", room, ban.By)
+	if !ban.Until.IsZero() {
+		reason += " until " + ban.Until.Format(time.RFC1123)
+	}
+	if ban.Reason != "" {
+		reason += ": " + ban.Reason
+	}
+	return reason, nil
+}
+
+// clientsMatching returns everyone in the room, members or not, for whom
+// match is true
+func (room *Room) clientsMatching(match func(client *serverclient.Client) bool) []*serverclient.Client {
+	var matching []*serverclient.Client
+	for _, client := range room.everyone() {
+		if match(client) {
+			matching = append(matching, client)
+		}
+	}
+	return matching
+}
+
+func (room *Room) clientsNamed(username string) []*serverclient.Client {
+	return room.clientsMatching(func(client *serverclient.Client) bool {
+		return strings.EqualFold(client.Username, username)
+	})
+}
+
+// remove tells clients why they are removed from the room and disconnects
+// them. They cannot resume their sessions, so the room key is rotated once
+// they are gone.
+func (room *Room) remove(clients []*serverclient.Client, kicked *comm.Kicked) {
+	room.mu.Lock()
+	for _, client := range clients {
+		if room.clients[client] || room.joining[client] {
+			room.noResume[client] = true
+		}
+	}
+	room.mu.Unlock()
+
+	for _, client := range clients {
+		client.Send(kicked)
+		go client.Close(websocket.ClosePolicyViolation, "kicked")
+	}
+}
+
+// dropSessions ends the sessions username left behind that could still be
+// resumed, and rotates the room key if there were any
+func (room *Room) dropSessions(username string) {
+	room.mu.Lock()
+	dropped := false
+	for id, session := range room.sessions {
+		if strings.EqualFold(session.username, username) {
+			session.timer.Stop()
+			delete(room.sessions, id)
+			dropped = true
+		}
+	}
+	room.mu.Unlock()
+
+	if dropped {
+		room.rekey()
+	}
+}
+
+// mutedFor reports whether username is muted in the room, and for how much
+// longer. A mute without an end has 0 left.
+func (room *Room) mutedFor(username string) (time.Duration, bool) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	until, ok := room.mutes[strings.ToLower(username)]
+	if !ok {
+		return 0, false
+	}
+	if until.IsZero() {
+		return 0, true
+	}
+	left := time.Until(until)
+	if left <= 0 {
+		delete(room.mutes, strings.ToLower(username))
+		return 0, false
+	}
+	return left, true
+}
+
+// moderate carries out an operator's request and tells the room about it
+func (room *Room) moderate(operator *serverclient.Client, id string, req *comm.Moderate) {
+	server := room.server
+	if !server.isOperator(room.Name, operator.Username) {
+		operator.SendError(id, comm.ErrCodeForbidden, fmt.Sprintf("only operators of %s can moderate it", room.Name))
+		return
+	}
+	if req.Username == "" {
+		operator.SendError(id, comm.ErrCodeBadRequest, "username is required")
+		return
+	}
+	if server.isOperator(room.Name, req.Username) {
+		operator.SendError(id, comm.ErrCodeForbidden, fmt.Sprintf("%s is an operator", req.Username))
+		return
+	}
+	var until time.Time
+	duration := time.Duration(req.Duration) * time.Second
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	targets := room.clientsNamed(req.Username)
+
+	var notice string
+	switch req.Action {
+	case comm.ActionKick:
+		if len(targets) == 0 {
+			operator.SendError(id, comm.ErrCodeNoSuchUser, fmt.Sprintf("%s is not in %s", req.Username, room.Name))
+			return
+		}
+		room.remove(targets, &comm.Kicked{By: operator.Username, Reason: req.Reason})
+		notice = fmt.Sprintf("%s was kicked by %s", req.Username, operator.Username)
+
+	case comm.ActionBan:
+		ban := Ban{Room: room.Name, Match: req.Match, Username: req.Username, By: operator.Username, Reason: req.Reason, Until: until}
+		switch req.Match {
+		case "", comm.BanUsername:
+			ban.Match = comm.BanUsername
+			ban.Value = req.Username
+		case comm.BanSession, comm.BanIP:
+			if len(targets) == 0 {
+				operator.SendError(id, comm.ErrCodeNoSuchUser, fmt.Sprintf("%s is not in %s", req.Username, room.Name))
+				return
+			}
+			ban.Value = targets[0].Session
+			if req.Match == comm.BanIP {
+				ban.Value = targets[0].Addr
+			}
+			if ban.Value == "" {
+				operator.SendError(id, comm.ErrCodeBadRequest, fmt.Sprintf("%s has no %s to ban", req.Username, req.Match))
+				return
+			}
+		default:
+			operator.SendError(id, comm.ErrCodeBadRequest, fmt.Sprintf("cannot ban by %s", req.Match))
+			return
+		}
+		err := server.opts.Bans.Add(ban)
+		if err != nil {
+			server.log.Println("ban:", err)
+			operator.SendError(id, comm.ErrCodeInternal, "could not save the ban")
+			return
+		}
+
+		// An IP or session ban may catch more clients than the one named
+		kicked := &comm.Kicked{By: operator.Username, Reason: req.Reason, Banned: true}
+		if !until.IsZero() {
+			kicked.Until = until.Unix()
+		}
+		room.remove(room.clientsMatching(func(client *serverclient.Client) bool {
+			return !server.isOperator(room.Name, client.Username) && ban.matches(client.Username, client.Session, client.Addr)
+		}), kicked)
+		room.dropSessions(req.Username)
+		notice = fmt.Sprintf("%s was banned by %s", req.Username, operator.Username)
+
+	case comm.ActionUnban:
+		removed, err := server.opts.Bans.Remove(room.Name, req.Username)
+		if err != nil {
+			server.log.Println("unban:", err)
+			operator.SendError(id, comm.ErrCodeInternal, "could not save the ban list")
+			return
+		}
+		if removed == 0 {
+			operator.SendError(id, comm.ErrCodeNoSuchUser, fmt.Sprintf("%s is not banned from %s", req.Username, room.Name))
+			return
+		}
+		notice = fmt.Sprintf("%s was unbanned by %s", req.Username, operator.Username)
+
+	case comm.ActionMute:
+		if len(targets) == 0 {
+			operator.SendError(id, comm.ErrCodeNoSuchUser, fmt.Sprintf("%s is not in %s", req.Username, room.Name))
+			return
+		}
+		room.mu.Lock()
+		room.mutes[strings.ToLower(req.Username)] = until
+		room.mu.Unlock()
+		notice = fmt.Sprintf("%s was muted by %s", req.Username, operator.Username)
+
+	case comm.ActionUnmute:
+		_, muted := room.mutedFor(req.Username)
+		if !muted {
+			operator.SendError(id, comm.ErrCodeNoSuchUser, fmt.Sprintf("%s is not muted", req.Username))
+			return
+		}
+		room.mu.Lock()
+		delete(room.mutes, strings.ToLower(req.Username))
+		room.mu.Unlock()
+		notice = fmt.Sprintf("%s was unmuted by %s", req.Username, operator.Username)
+
+	default:
+		operator.SendError(id, comm.ErrCodeBadRequest, fmt.Sprintf("unknown action %q", req.Action))
+		return
+	}
+
+	if duration > 0 && (req.Action == comm.ActionBan || req.Action == comm.ActionMute) {
+		notice += " for " + formatDuration(duration)
+	}
+	if req.Reason != "" {
+		notice += ": " + req.Reason
+	}
+	server.log.Printf("Room %q: %s\n", room.Name, notice)
+	room.send(MessageEvent{message: &comm.Notice{Text: notice}, client: operator})
+	room.send(MessageEvent{id: id, message: &comm.Moderated{Text: notice}, recipient: operator})
+}
+
+// formatDuration writes durations the way people say them, as 1h rather
+// than 1h0m0s
+func formatDuration(duration time.Duration) string {
+	text := duration.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
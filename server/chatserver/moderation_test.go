@@ -0,0 +1,30 @@
+package chatserver
+
+import (
+	"errors"
+	"testing"
+	"websocket-chat/comm"
+)
+
+func TestOperatorsAreNotKeptOutByAddressBans(t *testing.T) {
+	bans, err := NewFileBanList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everyone in the test connects from the banned address
+	err = bans.Add(Ban{Room: "general", Match: comm.BanIP, Value: "127.0.0.1", Username: "mallory", By: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cfg := startServer(t, Options{Operators: map[string][]string{"*": {"admin"}}, Bans: bans})
+
+	_, err = dial(t, cfg, "bob")
+	var rejection *comm.Error
+	if !errors.As(err, &rejection) || rejection.Code != comm.ErrCodeBanned {
+		t.Fatalf("bob joining: got %v, want %s", err, comm.ErrCodeBanned)
+	}
+	_, err = dial(t, cfg, "admin")
+	if err != nil {
+		t.Fatal("the operator could not join:", err)
+	}
+}
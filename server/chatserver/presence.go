@@ -0,0 +1,94 @@
+package chatserver
+
+import (
+	"sort"
+	"time"
+	"websocket-chat/comm"
+	serverclient "websocket-chat/server/serverClient"
+)
+
+// Members who have not sent anything for idleTimeout are shown as idle. The
+// room looks for them every idleCheckInterval.
+const (
+	idleTimeout       = 5 * time.Minute
+	idleCheckInterval = 30 * time.Second
+)
+
+type presence struct {
+	lastActive time.Time
+	idle       bool
+}
+
+// announcePresence tells everyone else in the room about client
+func (room *Room) announcePresence(client *serverclient.Client, status comm.PresenceStatus) {
+	operator := room.server.isOperator(room.Name, client.Username)
+	room.send(MessageEvent{message: &comm.Presence{Username: client.Username, Status: status, Operator: operator}, client: client})
+}
+
+// touch records that client just sent something, and tells the room if it
+// was idle until now
+func (room *Room) touch(client *serverclient.Client) {
+	room.mu.Lock()
+	p, ok := room.presence[client]
+	wasIdle := false
+	if ok {
+		wasIdle = p.idle
+		p.lastActive = time.Now()
+		p.idle = false
+	}
+	room.mu.Unlock()
+
+	if wasIdle {
+		room.announcePresence(client, comm.PresenceActive)
+	}
+}
+
+// watchIdle marks members idle once they have been quiet for idleTimeout
+func (room *Room) watchIdle() {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-room.server.done:
+			return
+		case <-room.closed:
+			return
+		}
+		// Mutes and sessions run out without anyone leaving
+		room.server.removeIfEmpty(room)
+
+		var idle []*serverclient.Client
+		room.mu.Lock()
+		for client, p := range room.presence {
+			if !p.idle && time.Since(p.lastActive) > idleTimeout {
+				p.idle = true
+				idle = append(idle, client)
+			}
+		}
+		room.mu.Unlock()
+
+		for _, client := range idle {
+			room.announcePresence(client, comm.PresenceIdle)
+		}
+	}
+}
+
+// sendMembers answers a who request
+func (room *Room) sendMembers(client *serverclient.Client, id string) {
+	room.mu.Lock()
+	members := make([]comm.Member, 0, len(room.clients))
+	for member := range room.clients {
+		idle := false
+		if p, ok := room.presence[member]; ok {
+			idle = p.idle
+		}
+		members = append(members, comm.Member{Username: member.Username, Idle: idle, Operator: room.server.isOperator(room.Name, member.Username)})
+	}
+	room.mu.Unlock()
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Username < members[j].Username
+	})
+	room.send(MessageEvent{id: id, message: &comm.Members{Members: members}, recipient: client})
+}
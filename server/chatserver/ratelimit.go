@@ -0,0 +1,248 @@
+package chatserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"websocket-chat/comm"
+	serverclient "websocket-chat/server/serverClient"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages over the limit count as strikes against their sender until the
+// sender has kept to the limit for this long
+const strikeWindow = time.Minute
+
+// RateLimit says how many frames clients may send and what happens to those
+// who send more. Chat messages and everything else a client sends after
+// joining count alike. Zero fields take the defaults in defaultRateLimit.
+type RateLimit struct {
+	// Frames per second each connection may send on average, and how many
+	// it may send in a burst
+	Rate  float64
+	Burst int
+	// The same for each username, over all of its connections
+	UserRate  float64
+	UserBurst int
+	// Longest message or sender key, as the length of its ciphertext
+	MaxMessageLength int
+	// Strikes before the sender is muted, and for how long
+	MuteAfter    int
+	MuteDuration time.Duration
+	// Strikes before the sender is disconnected
+	DisconnectAfter int
+}
+
+var defaultRateLimit = RateLimit{
+	Rate:             5,
+	Burst:            10,
+	UserRate:         10,
+	UserBurst:        20,
+	MaxMessageLength: 8 * 1024,
+	MuteAfter:        5,
+	MuteDuration:     30 * time.Second,
+	DisconnectAfter:  20,
+}
+
+func (limit *RateLimit) setDefaults() {
+	if limit.Rate <= 0 {
+		limit.Rate = defaultRateLimit.Rate
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = defaultRateLimit.Burst
+	}
+	if limit.UserRate <= 0 {
+		limit.UserRate = defaultRateLimit.UserRate
+	}
+	if limit.UserBurst <= 0 {
+		limit.UserBurst = defaultRateLimit.UserBurst
+	}
+	if limit.MaxMessageLength <= 0 {
+		limit.MaxMessageLength = defaultRateLimit.MaxMessageLength
+	}
+	if limit.MuteAfter <= 0 {
+		limit.MuteAfter = defaultRateLimit.MuteAfter
+	}
+	if limit.MuteDuration <= 0 {
+		limit.MuteDuration = defaultRateLimit.MuteDuration
+	}
+	if limit.DisconnectAfter <= 0 {
+		limit.DisconnectAfter = defaultRateLimit.DisconnectAfter
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if there is one. Tokens come back at rate per second,
+// up to burst.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// A sender is everything we know about how fast a username has been sending
+type sender struct {
+	bucket      tokenBucket
+	connections int
+	strikes     int
+	lastStrike  time.Time
+	mutedUntil  time.Time
+}
+
+// What happens to a message
+type verdict int
+
+const (
+	allow verdict = iota
+	tooLong
+	warn
+	mute
+	muted
+	disconnect
+)
+
+// floodGuard keeps the senders of every connected username, ignoring case
+// like the rest of the server does. Muted senders are kept after they
+// disconnect, so that reconnecting does not lift the mute, until the mute is
+// over.
+type floodGuard struct {
+	mu      sync.Mutex
+	senders map[string]*sender
+}
+
+func (g *floodGuard) connect(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := strings.ToLower(username)
+	s, ok := g.senders[key]
+	if !ok {
+		s = &sender{}
+		g.senders[key] = s
+	}
+	s.connections++
+}
+
+func (g *floodGuard) disconnect(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.senders[strings.ToLower(username)]
+	if ok {
+		s.connections--
+	}
+	// Also forget those whose mute ran out after they left
+	now := time.Now()
+	for key, s := range g.senders {
+		if s.connections <= 0 && now.After(s.mutedUntil) {
+			delete(g.senders, key)
+		}
+	}
+}
+
+// check decides what to do with a frame from username on the connection
+// whose bucket is given. Muted senders may not chat, but may send the other
+// frames as long as they keep to the limit. For muted senders, it also
+// returns how much longer the mute lasts.
+func (g *floodGuard) check(username string, bucket *tokenBucket, limit RateLimit, chat bool) (verdict, time.Duration) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.senders[strings.ToLower(username)]
+	if !ok {
+		// Only connected usernames are checked
+		return allow, 0
+	}
+	if now.Sub(s.lastStrike) > strikeWindow {
+		s.strikes = 0
+	}
+
+	if chat && now.Before(s.mutedUntil) {
+		s.strikes++
+		s.lastStrike = now
+		if s.strikes >= limit.DisconnectAfter {
+			return disconnect, 0
+		}
+		return muted, s.mutedUntil.Sub(now)
+	}
+	connectionOk := bucket.take(now, limit.Rate, limit.Burst)
+	userOk := s.bucket.take(now, limit.UserRate, limit.UserBurst)
+	if connectionOk && userOk {
+		return allow, 0
+	}
+
+	s.strikes++
+	s.lastStrike = now
+	switch {
+	case s.strikes >= limit.DisconnectAfter:
+		// Coming straight back does not help
+		s.mutedUntil = now.Add(limit.MuteDuration)
+		return disconnect, 0
+	case s.strikes >= limit.MuteAfter:
+		s.mutedUntil = now.Add(limit.MuteDuration)
+		return mute, limit.MuteDuration
+	default:
+		return warn, 0
+	}
+}
+
+// checkFrame checks a frame against the rate limit and tells the client if
+// it was dropped. Unless the verdict is allow, the frame must be dropped. On
+// disconnect, the connection is being closed and nothing more should be read
+// from it.
+func (s *Server) checkFrame(client *serverclient.Client, id string, msg comm.Message, bucket *tokenBucket) verdict {
+	limit := s.options().RateLimit
+	var ciphertext string
+	switch msg := msg.(type) {
+	case *comm.Text:
+		ciphertext = msg.Ciphertext
+	case *comm.SenderKey:
+		ciphertext = msg.Ciphertext
+	}
+	if len(ciphertext) > limit.MaxMessageLength {
+		client.SendError(id, comm.ErrCodeMessageTooLong, fmt.Sprintf("messages may be at most %d bytes once encrypted", limit.MaxMessageLength))
+		return tooLong
+	}
+
+	_, chat := msg.(*comm.Text)
+	verdict, remaining := s.floods.check(client.Username, bucket, limit, chat)
+	switch verdict {
+	case warn:
+		client.SendError(id, comm.ErrCodeRateLimited, "slow down, message dropped")
+	case mute:
+		s.log.Printf("Muted %s for %s for flooding\n", client.Username, remaining)
+		client.SendError(id, comm.ErrCodeMuted, fmt.Sprintf("muted for %s", remaining.Round(time.Second)))
+	case muted:
+		client.SendError(id, comm.ErrCodeMuted, fmt.Sprintf("still muted for %s", remaining.Round(time.Second)))
+	case disconnect:
+		s.log.Printf("Disconnected %s for flooding\n", client.Username)
+		client.SendError(id, comm.ErrCodeRateLimited, "disconnected for flooding")
+		client.Close(websocket.ClosePolicyViolation, "flooding")
+	}
+	return verdict
+}
+
+// rejectFrame charges a frame we cannot use against the rate limit and, unless
+// it was dropped for that already, answers it with reply. It returns false
+// once the client is being disconnected.
+func (s *Server) rejectFrame(client *serverclient.Client, id string, reply *comm.Error, bucket *tokenBucket) bool {
+	switch s.checkFrame(client, id, nil, bucket) {
+	case allow:
+		client.SendFrame(id, reply)
+	case disconnect:
+		return false
+	}
+	return true
+}
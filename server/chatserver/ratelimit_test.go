@@ -0,0 +1,88 @@
+package chatserver
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+	"websocket-chat/comm"
+
+	"github.com/gorilla/websocket"
+)
+
+// rawJoin joins the room over a bare websocket, so that the test can send
+// frames no real client would
+func rawJoin(t *testing.T, host string, port int, username string) *websocket.Conn {
+	t.Helper()
+	u := url.URL{Scheme: "ws", Host: net.JoinHostPort(host, strconv.Itoa(port)), Path: "/ws"}
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	envelope, err := comm.Encode(comm.ProtocolVersion, "join", &comm.Join{Username: username, Versions: comm.SupportedVersions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.WriteJSON(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply comm.Envelope
+	err = conn.ReadJSON(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Kind != comm.KindJoinAccepted {
+		t.Fatalf("joining: got %s, want %s", reply.Kind, comm.KindJoinAccepted)
+	}
+	return conn
+}
+
+// isDisconnected reads until the server closes conn, or gives up. The close
+// frame may be lost if the server resets the connection while we still write.
+func isDisconnected(conn *websocket.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			var netError net.Error
+			return !errors.As(err, &netError) || !netError.Timeout()
+		}
+	}
+}
+
+func TestBadFramesAreCharged(t *testing.T) {
+	bogusRoomKey, err := comm.Encode(comm.ProtocolVersion, "no-such-exchange", &comm.RoomKey{Ciphertext: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	floods := map[string]func(conn *websocket.Conn) error{
+		"garbage": func(conn *websocket.Conn) error {
+			return conn.WriteMessage(websocket.TextMessage, []byte("{not json"))
+		},
+		"unknown kind": func(conn *websocket.Conn) error {
+			return conn.WriteJSON(comm.Envelope{Version: comm.ProtocolVersion, Kind: "no-such-kind"})
+		},
+		"key exchange frames of no exchange": func(conn *websocket.Conn) error {
+			return conn.WriteJSON(bogusRoomKey)
+		},
+	}
+	for name, send := range floods {
+		t.Run(name, func(t *testing.T) {
+			_, cfg := startServer(t, Options{})
+			conn := rawJoin(t, cfg.Host, cfg.Port, "mallory")
+			for range 100 {
+				if send(conn) != nil {
+					break
+				}
+			}
+			if !isDisconnected(conn) {
+				t.Fatal("the client was not disconnected for flooding")
+			}
+		})
+	}
+}
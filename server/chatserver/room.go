@@ -0,0 +1,591 @@
+package chatserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"websocket-chat/comm"
+	serverclient "websocket-chat/server/serverClient"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long a member that lost its connection can come back without a key
+// exchange. The room key is only rotated once this has passed.
+const sessionResumeWindow = 30 * time.Second
+
+// A session is a member that disconnected and may come back
+type session struct {
+	username string
+	timer    *time.Timer
+}
+
+// A Room is a single chat channel. Every room has its own members, its own
+// key hub and its own broadcast loop, so messages and keys never cross rooms.
+type Room struct {
+	Name    string
+	server  *Server
+	clients map[*serverclient.Client]bool
+	// Clients that joined but are still waiting for the room key
+	joining   map[*serverclient.Client]bool
+	exchanges map[string]*keyExchange
+	// Exchanges that were called off lately, so that the frames their key
+	// hub or member sent before hearing of it are not charged
+	cancelled map[string]*keyExchange
+	// Departed members that can still resume, by session id
+	sessions map[string]*session
+	// Members that left on purpose or were kicked, whose sessions must not
+	// be resumed
+	noResume map[*serverclient.Client]bool
+	// Muted usernames, in lower case, and when their mute ends. A zero time
+	// means it lasts until an operator lifts it.
+	mutes map[string]time.Time
+	// When each member was last active
+	presence map[*serverclient.Client]*presence
+	// Signed identity keys members announced, relayed as-is to the others
+	identities map[*serverclient.Client]*comm.Identity
+	// Sender chains whose announcement is in the history already
+	recorded map[announcedChain]bool
+	// Sender keys each member owes the members that joined after it. New
+	// members ask everyone for their chains, and the answers are not charged
+	// to the rate limit.
+	owed map[*serverclient.Client]int
+	// The members each new member has not been handed the sender chain of
+	// yet. Their messages are not passed on to it until then, since it could
+	// not read them.
+	unseenChains map[*serverclient.Client]map[*serverclient.Client]bool
+	broadcast    chan MessageEvent
+	keyHub       *serverclient.Client
+	// Incremented every time the room key is rotated
+	epoch uint64
+	// Set once the room is removed. Clients that got the room before then
+	// have to get it again.
+	removed bool
+	// Closed when the room is removed, which stops its goroutines
+	closed chan struct{}
+	mu     sync.Mutex
+}
+
+// newRoom makes a room whose key epochs start at epoch
+func newRoom(server *Server, name string, epoch uint64) *Room {
+	return &Room{
+		Name:         name,
+		server:       server,
+		epoch:        epoch,
+		closed:       make(chan struct{}),
+		clients:      make(map[*serverclient.Client]bool),
+		joining:      make(map[*serverclient.Client]bool),
+		exchanges:    make(map[string]*keyExchange),
+		cancelled:    make(map[string]*keyExchange),
+		sessions:     make(map[string]*session),
+		noResume:     make(map[*serverclient.Client]bool),
+		mutes:        make(map[string]time.Time),
+		presence:     make(map[*serverclient.Client]*presence),
+		identities:   make(map[*serverclient.Client]*comm.Identity),
+		recorded:     make(map[announcedChain]bool),
+		owed:         make(map[*serverclient.Client]int),
+		unseenChains: make(map[*serverclient.Client]map[*serverclient.Client]bool),
+		broadcast:    make(chan MessageEvent),
+	}
+}
+
+// setKeyHub must be called with room.mu held
+func (room *Room) setKeyHub(client *serverclient.Client) {
+	room.keyHub = client
+}
+
+// chooseNewKeyHub must be called with room.mu held. If no member is left, a
+// client still waiting for the key becomes the key hub, and chooseNewKeyHub
+// returns true since it needs a new room key.
+func (room *Room) chooseNewKeyHub() bool {
+	room.keyHub = nil
+	for c := range room.clients {
+		room.setKeyHub(c)
+		return false
+	}
+	for c := range room.joining {
+		delete(room.joining, c)
+		room.addMember(c)
+		room.setKeyHub(c)
+		return true
+	}
+	return false
+}
+
+// addMember must be called with room.mu held
+func (room *Room) addMember(client *serverclient.Client) {
+	for member := range room.clients {
+		room.owed[member]++
+	}
+	room.clients[client] = true
+	room.presence[client] = &presence{lastActive: time.Now()}
+}
+
+// usernameTaken must be called with room.mu held. A name stays taken while
+// its owner can still resume their session, unless this is them resuming it.
+func (room *Room) usernameTaken(username string, sessionId string) bool {
+	for c := range room.clients {
+		if strings.EqualFold(c.Username, username) {
+			return true
+		}
+	}
+	for c := range room.joining {
+		if strings.EqualFold(c.Username, username) {
+			return true
+		}
+	}
+	for id, session := range room.sessions {
+		if id != sessionId && strings.EqualFold(session.username, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// join answers client's join request. The first client in a room becomes its
+// key hub and generates the room key. A member reconnecting within the
+// resume window with the current room key is a member again right away.
+// Everyone else gets the key from the key hub before they are admitted.
+// Clients whose username is already in use are turned away.
+func (room *Room) join(client *serverclient.Client, id string, join *comm.Join) error {
+	room.mu.Lock()
+	// Checked under the lock, so that Shutdown either sees this client or
+	// this client sees the shutdown
+	if room.server.isShuttingDown() {
+		room.mu.Unlock()
+		sendShutdown(client, id)
+		return errors.New("server is shutting down")
+	}
+	if room.removed {
+		room.mu.Unlock()
+		return errRoomRemoved
+	}
+	if room.usernameTaken(client.Username, client.Session) {
+		room.mu.Unlock()
+		client.SendError(id, comm.ErrCodeUsernameTaken, fmt.Sprintf("%s is already in room %s", client.Username, room.Name))
+		return fmt.Errorf("username %q is taken in room %q", client.Username, room.Name)
+	}
+	resumed := false
+	if session, ok := room.sessions[client.Session]; ok && client.Session != "" && session.username == client.Username {
+		// They are back, so there is no need to rotate the key for them
+		session.timer.Stop()
+		delete(room.sessions, client.Session)
+		resumed = join.Epoch == room.epoch && room.keyHub != nil
+	}
+
+	isKeyHub := room.keyHub == nil
+	switch {
+	case isKeyHub:
+		room.setKeyHub(client)
+		room.addMember(client)
+	case resumed:
+		room.addMember(client)
+	default:
+		room.joining[client] = true
+	}
+	epoch := room.epoch
+	room.mu.Unlock()
+
+	accepted := &comm.JoinAccepted{Version: client.Version, KeyHub: isKeyHub, Resumed: resumed}
+	room.send(MessageEvent{id: id, message: accepted, recipient: client})
+	switch {
+	case isKeyHub:
+		room.send(MessageEvent{message: &comm.GenerateKeys{Epoch: epoch}, recipient: client})
+		room.announcePresence(client, comm.PresenceJoined)
+	case resumed:
+		room.announcePresence(client, comm.PresenceJoined)
+	default:
+		room.startKeyExchange(client)
+	}
+	return nil
+}
+
+// admit makes a client that received the room key a member of the room
+func (room *Room) admit(client *serverclient.Client) {
+	room.mu.Lock()
+	joining := room.joining[client]
+	if joining {
+		delete(room.joining, client)
+		unseen := make(map[*serverclient.Client]bool)
+		for member := range room.clients {
+			unseen[member] = true
+		}
+		room.unseenChains[client] = unseen
+		room.addMember(client)
+	}
+	room.mu.Unlock()
+
+	if joining {
+		room.announcePresence(client, comm.PresenceJoined)
+	}
+}
+
+func (room *Room) isMember(client *serverclient.Client) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return room.clients[client]
+}
+
+// members returns a snapshot of the room's members
+func (room *Room) members() []*serverclient.Client {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	members := make([]*serverclient.Client, 0, len(room.clients))
+	for client := range room.clients {
+		members = append(members, client)
+	}
+	return members
+}
+
+// leave removes a disconnected client from the room. The departed client
+// still holds the room key, so the key is rotated once it can no longer
+// resume its session. If it was the key hub, the key is rotated right away
+// by the new key hub: the exchanges the old one had under way are lost, and
+// if it was rotating the key, the new one may not have the newest key.
+func (room *Room) leave(client *serverclient.Client) {
+	room.mu.Lock()
+	wasMember := room.clients[client]
+	delete(room.clients, client)
+	delete(room.presence, client)
+	delete(room.owed, client)
+	delete(room.unseenChains, client)
+	for _, unseen := range room.unseenChains {
+		delete(unseen, client)
+	}
+	delete(room.identities, client)
+	delete(room.joining, client)
+	endedSession := room.noResume[client]
+	delete(room.noResume, client)
+	room.cancelKeyExchanges(client)
+	needsKey := false
+	newKeyHub := room.keyHub
+	wasKeyHub := room.keyHub == client
+	if wasKeyHub {
+		needsKey = room.chooseNewKeyHub()
+		newKeyHub = room.keyHub
+	}
+	if wasMember && room.keyHub == nil {
+		// Nobody is left to rotate the key for, but whoever creates the next
+		// one must not reuse this epoch
+		room.epoch++
+	}
+
+	resumable := wasMember && client.Session != "" && !endedSession && !wasKeyHub && !room.server.isShuttingDown()
+	if resumable {
+		sessionId := client.Session
+		room.sessions[sessionId] = &session{
+			username: client.Username,
+			timer: time.AfterFunc(sessionResumeWindow, func() {
+				room.expireSession(sessionId)
+			}),
+		}
+	}
+	room.mu.Unlock()
+
+	if wasMember {
+		room.announcePresence(client, comm.PresenceLeft)
+	}
+	if needsKey {
+		// A client that was still waiting for the key became the key hub
+		room.announcePresence(newKeyHub, comm.PresenceJoined)
+	}
+	if wasMember && !resumable {
+		room.rekey()
+	}
+	room.server.removeIfEmpty(room)
+}
+
+// isEmpty reports whether the room has nobody in it and nothing worth
+// keeping it for: no one joining or able to resume, and no mutes in force.
+// Must be called with room.mu held.
+func (room *Room) isEmpty() bool {
+	if len(room.clients) > 0 || len(room.joining) > 0 || len(room.sessions) > 0 || len(room.exchanges) > 0 {
+		return false
+	}
+	for _, until := range room.mutes {
+		if until.IsZero() || time.Now().Before(until) {
+			return false
+		}
+	}
+	return true
+}
+
+// endSession makes sure client cannot resume its membership once it leaves,
+// so the room key is rotated right away
+func (room *Room) endSession(client *serverclient.Client) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	room.noResume[client] = true
+}
+
+// expireSession rotates the key once a departed member can no longer resume
+func (room *Room) expireSession(sessionId string) {
+	room.mu.Lock()
+	_, ok := room.sessions[sessionId]
+	delete(room.sessions, sessionId)
+	room.mu.Unlock()
+
+	if ok {
+		room.rekey()
+		room.server.removeIfEmpty(room)
+	}
+}
+
+// rekey starts a new key epoch. The key hub generates a fresh room key and
+// hands it to every other member through its own key exchange, so members who
+// have left cannot read anything sent from now on.
+func (room *Room) rekey() {
+	room.mu.Lock()
+	if room.keyHub == nil || room.server.isShuttingDown() {
+		room.mu.Unlock()
+		return
+	}
+	room.epoch++
+	epoch := room.epoch
+	// Chains of older epochs are not announced again, except by members
+	// that have not got the new key yet
+	for chain := range room.recorded {
+		if chain.epoch+1 < epoch {
+			delete(room.recorded, chain)
+		}
+	}
+	keyHub := room.keyHub
+	var others []*serverclient.Client
+	for client := range room.clients {
+		if client != keyHub {
+			others = append(others, client)
+		}
+	}
+	for client := range room.joining {
+		others = append(others, client)
+	}
+	room.mu.Unlock()
+
+	room.server.log.Printf("Rotating key for room %q to epoch %d\n", room.Name, epoch)
+	room.send(MessageEvent{message: &comm.GenerateKeys{Epoch: epoch}, recipient: keyHub})
+	for _, member := range others {
+		room.startKeyExchange(member)
+	}
+}
+
+// send queues an event for the room's message loop. It returns false if the
+// server shut down or the room was removed before the event could be queued.
+func (room *Room) send(event MessageEvent) bool {
+	select {
+	case room.broadcast <- event:
+		return true
+	case <-room.server.done:
+		return false
+	case <-room.closed:
+		return false
+	}
+}
+
+// sendPrivate passes a private message on to the member it is for
+func (room *Room) sendPrivate(client *serverclient.Client, id string, msg *comm.Text) {
+	for _, member := range room.members() {
+		if strings.EqualFold(member.Username, msg.To) {
+			room.send(MessageEvent{message: msg, client: client, recipient: member})
+			return
+		}
+	}
+	client.SendError(id, comm.ErrCodeNoSuchUser, fmt.Sprintf("%s is not in %s", msg.To, room.Name))
+}
+
+// announceIdentity relays a client's signed identity key to the rest of the
+// room and sends it the identity keys of everyone already here. Clients check
+// the signatures themselves; the server only stores and forwards them.
+func (room *Room) announceIdentity(client *serverclient.Client, announcement *comm.Identity) {
+	announcement.Username = client.Username
+	room.mu.Lock()
+	room.identities[client] = announcement
+	var others []*comm.Identity
+	for member, identity := range room.identities {
+		if member != client {
+			others = append(others, identity)
+		}
+	}
+	room.mu.Unlock()
+
+	room.send(MessageEvent{message: announcement, client: client})
+	for _, identity := range others {
+		room.send(MessageEvent{message: identity, recipient: client})
+	}
+}
+
+// takeOwed reports whether client owed the sender key it just sent to a
+// member that joined, and crosses it off
+func (room *Room) takeOwed(client *serverclient.Client) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.owed[client] == 0 {
+		return false
+	}
+	room.owed[client]--
+	return true
+}
+
+// passOn reports whether msg from sender goes to recipient. A new member only
+// gets another member's messages once it got that member's sender chain.
+func (room *Room) passOn(sender *serverclient.Client, recipient *serverclient.Client, msg comm.Message) bool {
+	if sender == nil {
+		return true
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	unseen := room.unseenChains[recipient]
+	switch msg.(type) {
+	case *comm.SenderKey:
+		delete(unseen, sender)
+		if len(unseen) == 0 {
+			delete(room.unseenChains, recipient)
+		}
+	case *comm.Text:
+		return !unseen[sender]
+	}
+	return true
+}
+
+// An announcedChain is one member's sender chain in one epoch
+type announcedChain struct {
+	username string
+	chain    string
+	epoch    uint64
+}
+
+// recordSenderKey adds a sender key to the room's history unless its chain
+// was announced before. Members announce their chains again for everyone who
+// joins, and those announcements would crowd the messages out of the history.
+func (room *Room) recordSenderKey(msg *comm.SenderKey) {
+	chain := announcedChain{username: strings.ToLower(msg.Username), chain: msg.Chain, epoch: msg.Epoch}
+	room.mu.Lock()
+	recorded := room.recorded[chain]
+	room.recorded[chain] = true
+	room.mu.Unlock()
+	if !recorded {
+		room.record(msg)
+	}
+}
+
+// record adds a relayed message to the room's history
+func (room *Room) record(msg comm.Message) {
+	store := room.server.opts.Store
+	if store == nil {
+		return
+	}
+	envelope, err := comm.Encode(comm.ProtocolVersion, "", msg)
+	if err == nil {
+		err = store.Append(room.Name, envelope)
+	}
+	if err != nil {
+		room.server.log.Println("record message:", err)
+	}
+}
+
+// sendHistory answers a history request with the room's most recent messages
+func (room *Room) sendHistory(client *serverclient.Client, id string, limit int) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	result := &comm.HistoryResult{}
+	store := room.server.opts.Store
+	if store != nil {
+		messages, err := store.Recent(room.Name, limit)
+		if err != nil {
+			room.server.log.Println("history:", err)
+			client.SendError(id, comm.ErrCodeInternal, "could not load history")
+			return
+		}
+		result.Messages = messages
+	}
+	room.send(MessageEvent{id: id, message: result, recipient: client})
+}
+
+// everyone returns all clients in the room, including those still waiting
+// for the key
+func (room *Room) everyone() []*serverclient.Client {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	clients := make([]*serverclient.Client, 0, len(room.clients)+len(room.joining))
+	for client := range room.clients {
+		clients = append(clients, client)
+	}
+	for client := range room.joining {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// announceShutdown tells everyone in the room that the server is going away
+func (room *Room) announceShutdown() {
+	for _, client := range room.everyone() {
+		err := client.Send(&comm.Shutdown{Message: shutdownMessage})
+		if err != nil {
+			room.server.log.Println("announce shutdown:", err)
+		}
+	}
+}
+
+func (room *Room) pendingKeyExchanges() int {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return len(room.exchanges)
+}
+
+// disconnectAll closes every connection in the room with a close frame, so
+// clients know to come back later. Clients are closed side by side, since
+// each may take up to the write timeout to flush its queue.
+func (room *Room) disconnectAll() {
+	var wg sync.WaitGroup
+	for _, client := range room.everyone() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Close(websocket.CloseGoingAway, shutdownMessage)
+		}()
+	}
+	wg.Wait()
+}
+
+// deliver queues a frame for one client. Queueing only waits on the client
+// under the block policy, so one slow client does not hold up the room.
+func (room *Room) deliver(client *serverclient.Client, id string, msg comm.Message) {
+	err := client.SendFrame(id, msg)
+	if errors.Is(err, serverclient.ErrSlowConsumer) {
+		room.server.log.Printf("Disconnected %s from room %q, too slow to keep up\n", client.Username, room.Name)
+	} else if err != nil && !errors.Is(err, serverclient.ErrClosed) {
+		room.server.log.Println("handle messages:", err)
+		client.Disconnect()
+	}
+}
+
+func (room *Room) handleMessages() {
+	for {
+		var msgEvent MessageEvent
+		select {
+		case msgEvent = <-room.broadcast:
+		case <-room.server.done:
+			return
+		case <-room.closed:
+			return
+		}
+
+		if msgEvent.recipient != nil {
+			if room.passOn(msgEvent.client, msgEvent.recipient, msgEvent.message) {
+				room.deliver(msgEvent.recipient, msgEvent.id, msgEvent.message)
+			}
+		} else {
+			for _, client := range room.members() {
+				if client != msgEvent.client && room.passOn(msgEvent.client, client, msgEvent.message) {
+					room.deliver(client, msgEvent.id, msgEvent.message)
+				}
+			}
+		}
+	}
+}
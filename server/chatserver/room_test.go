@@ -0,0 +1,367 @@
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"websocket-chat/client/chatclient"
+)
+
+// A proxy passes one client's connections on to the server, so that a test
+// can cut them off without the client saying goodbye
+type proxy struct {
+	listener net.Listener
+	target   string
+	conns    []net.Conn
+	held     bool
+	mu       sync.Mutex
+	// Held while what the client sends is not passed on
+	gate sync.RWMutex
+}
+
+// startProxy returns a proxy to the server in cfg, and cfg changed to
+// connect through it
+func startProxy(t *testing.T, cfg chatclient.Config) (*proxy, chatclient.Config) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{listener: listener, target: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))}
+	t.Cleanup(func() {
+		listener.Close()
+		p.cut()
+	})
+	go p.run()
+
+	cfg.Port = listener.Addr().(*net.TCPAddr).Port
+	return p, cfg
+}
+
+func (p *proxy) run() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, conn, upstream)
+		p.mu.Unlock()
+		go io.Copy(conn, upstream)
+		go p.forward(upstream, conn)
+	}
+}
+
+// forward passes on what the client sends, unless the proxy holds it
+func (p *proxy) forward(upstream net.Conn, conn net.Conn) {
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		p.gate.RLock()
+		_, err = upstream.Write(buffer[:n])
+		p.gate.RUnlock()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// hold stops passing on what the client sends until the connections are cut,
+// so that the server waits for the client without it being gone
+func (p *proxy) hold() {
+	p.gate.Lock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.held = true
+}
+
+// cut drops every connection through the proxy
+func (p *proxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+	if p.held {
+		p.held = false
+		p.gate.Unlock()
+	}
+}
+
+// A member is a client whose chat messages are collected as they come in
+type member struct {
+	client   *chatclient.Client
+	received map[string]bool
+	mu       sync.Mutex
+}
+
+func join(t *testing.T, cfg chatclient.Config, username string) (*member, error) {
+	client, err := dial(t, cfg, username)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", username, err)
+	}
+	m := &member{client: client, received: make(map[string]bool)}
+	go func() {
+		for event := range client.Messages() {
+			if event.Type == chatclient.ChatMessage {
+				m.mu.Lock()
+				m.received[event.Username+": "+event.Text] = true
+				m.mu.Unlock()
+			}
+		}
+	}()
+	return m, nil
+}
+
+func (m *member) hasReceived(message string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.received[message]
+}
+
+// roomState is what the server knows about a room at one moment
+type roomState struct {
+	keyHub    string
+	epoch     uint64
+	members   map[string]bool
+	joining   int
+	exchanges int
+	// Sender chains new members are still waiting for
+	unseenChains int
+}
+
+func (s *Server) roomState(name string) roomState {
+	s.roomsMu.Lock()
+	room := s.rooms[name]
+	s.roomsMu.Unlock()
+	state := roomState{members: make(map[string]bool)}
+	if room == nil {
+		return state
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.keyHub != nil {
+		state.keyHub = room.keyHub.Username
+	}
+	state.epoch = room.epoch
+	for client := range room.clients {
+		state.members[client.Username] = true
+	}
+	state.joining = len(room.joining)
+	state.exchanges = len(room.exchanges)
+	for _, unseen := range room.unseenChains {
+		state.unseenChains += len(unseen)
+	}
+	return state
+}
+
+// checkConverged waits until exactly the given members are in the room, all
+// on the room's key epoch, and then checks that each of them can read what
+// the others send
+func checkConverged(t *testing.T, server *Server, members []*member) {
+	t.Helper()
+	var state roomState
+	defer func() {
+		if t.Failed() {
+			t.Logf("room: %+v", state)
+			for _, m := range members {
+				t.Logf("%s is on epoch %d", m.client.Username(), m.client.Epoch())
+			}
+		}
+	}()
+	eventually(t, "the room settles", func() bool {
+		state = server.roomState("general")
+		if len(state.members) != len(members) || state.joining > 0 || state.exchanges > 0 || state.unseenChains > 0 {
+			return false
+		}
+		for _, m := range members {
+			if !state.members[m.client.Username()] || m.client.Epoch() != state.epoch {
+				return false
+			}
+		}
+		return true
+	})
+	if state.keyHub == "" || !state.members[state.keyHub] {
+		t.Fatalf("key hub %q is not a member", state.keyHub)
+	}
+
+	for _, sender := range members {
+		text := fmt.Sprintf("epoch %d check", state.epoch)
+		err := sender.client.Send(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := sender.client.Username() + ": " + text
+		for _, receiver := range members {
+			if receiver == sender {
+				continue
+			}
+			eventually(t, receiver.client.Username()+" reads "+message, func() bool {
+				return receiver.hasReceived(message)
+			})
+		}
+	}
+}
+
+func TestConcurrentJoinsAndLeaves(t *testing.T) {
+	server, cfg := startServer(t, Options{})
+	var stable []*member
+	for _, username := range []string{"alice", "bob", "carol"} {
+		m, err := join(t, cfg, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stable = append(stable, m)
+	}
+
+	// Members come and go all at once. Half of them leave properly, the
+	// others lose their connection.
+	const workers, rounds = 12, 3
+	var wg sync.WaitGroup
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := range rounds {
+				clientCfg := cfg
+				var p *proxy
+				if (worker+round)%2 == 1 {
+					p, clientCfg = startProxy(t, cfg)
+				}
+				m, err := join(t, clientCfg, fmt.Sprintf("user%d-%d", worker, round))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				err = m.client.Send("hello")
+				if err != nil {
+					t.Error(err)
+				}
+				if p != nil {
+					p.cut()
+				} else {
+					m.client.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	checkConverged(t, server, stable)
+}
+
+func TestKeyHubFailover(t *testing.T) {
+	server, cfg := startServer(t, Options{})
+	hubProxy, hubCfg := startProxy(t, cfg)
+	alice, err := join(t, hubCfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := []*member{}
+	for _, username := range []string{"bob", "carol"} {
+		m, err := join(t, cfg, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining = append(remaining, m)
+	}
+	if state := server.roomState("general"); state.keyHub != alice.client.Username() {
+		t.Fatalf("key hub is %q, want alice", state.keyHub)
+	}
+
+	// The key hub goes away while it is handing the room key to new members
+	hubProxy.hold()
+	var wg sync.WaitGroup
+	joined := make([]*member, 4)
+	for i := range joined {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := join(t, cfg, fmt.Sprintf("late%d", i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			joined[i] = m
+		}()
+	}
+	eventually(t, "the key exchanges start", func() bool {
+		return server.roomState("general").exchanges == len(joined)
+	})
+	hubProxy.cut()
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	eventually(t, "alice is gone", func() bool {
+		return !server.roomState("general").members["alice"]
+	})
+	state := server.roomState("general")
+	if state.keyHub == "" || state.keyHub == "alice" {
+		t.Fatalf("key hub is %q after alice left", state.keyHub)
+	}
+	checkConverged(t, server, append(remaining, joined...))
+}
+
+func TestKeyHubFailoverWithoutMembers(t *testing.T) {
+	// Everyone else is still waiting for the key when the key hub goes
+	server, cfg := startServer(t, Options{})
+	hubProxy, hubCfg := startProxy(t, cfg)
+	_, err := join(t, hubCfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hubProxy.hold()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	var bob *member
+	go func() {
+		var err error
+		bob, err = join(t, cfg, "bob")
+		done <- err
+	}()
+	eventually(t, "a key exchange starts", func() bool {
+		return server.roomState("general").exchanges > 0
+	})
+	hubProxy.cut()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		t.Fatal("bob never got a room key")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "bob is the key hub", func() bool {
+		return server.roomState("general").keyHub == "bob"
+	})
+	carol, err := join(t, cfg, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConverged(t, server, []*member{bob, carol})
+}
@@ -0,0 +1,713 @@
+// Package chatserver implements the websocket chat server. A Server can be
+// mounted inside an existing HTTP service through Handler, or run on its own
+// listener with Serve.
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"websocket-chat/comm"
+	serverclient "websocket-chat/server/serverClient"
+	"websocket-chat/util"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrServerClosed = errors.New("chatserver: server closed")
+
+var (
+	errShuttingDown = errors.New("server is shutting down")
+	errTooManyRooms = errors.New("too many rooms")
+	errRoomRemoved  = errors.New("room was removed")
+)
+
+// Longest room name, in characters, and how many rooms there may be unless
+// Options.MaxRooms says otherwise
+const (
+	maxRoomNameLength = 64
+	defaultMaxRooms   = 1000
+)
+
+// What clients are told when the server shuts down
+const shutdownMessage = "server shutting down"
+
+// Nobody may join with these names, whatever the case, so that no one can
+// pass themselves off as the server
+var reservedUsernames = []string{"server"}
+
+func isReserved(username string) bool {
+	for _, reserved := range reservedUsernames {
+		if strings.EqualFold(username, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// Longest username, in characters
+const maxUsernameLength = 32
+
+// checkUsername says why a username cannot be used, or returns nil if it can
+func checkUsername(username string) error {
+	if strings.TrimSpace(username) == "" {
+		return errors.New("username is required")
+	}
+	return checkName("usernames", username, maxUsernameLength)
+}
+
+// checkName says why a name cannot be used, or returns nil if it can. Names
+// must look the way they are compared and displayed, so they may not start or
+// end with spaces or hide invisible characters. What names them in errors.
+func checkName(what string, name string, maxLength int) error {
+	if strings.TrimSpace(name) != name {
+		return fmt.Errorf("%s may not start or end with spaces", what)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%s must be valid UTF-8", what)
+	}
+	if utf8.RuneCountInString(name) > maxLength {
+		return fmt.Errorf("%s may be at most %d characters", what, maxLength)
+	}
+	for _, r := range name {
+		// Cf holds the zero-width and direction marks
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return fmt.Errorf("%s may not contain %U", what, r)
+		}
+	}
+	return nil
+}
+
+type MessageEvent struct {
+	// Correlation id of the frame, if any
+	id        string
+	message   comm.Message
+	client    *serverclient.Client
+	recipient *serverclient.Client
+}
+
+type Options struct {
+	// Room that clients join when their join message does not name one.
+	// Defaults to comm.DefaultRoom.
+	DefaultRoom string
+	// Logger receives the server's diagnostics. Defaults to log.Default().
+	Logger *log.Logger
+	// Store keeps each room's messages for clients that ask for history.
+	// History is not kept if it is nil.
+	Store MessageStore
+	// Authenticator checks passwords at /login. If it is set, /ws only
+	// accepts upgrades carrying a token from /login, and clients can only
+	// join as the user they logged in as.
+	Authenticator Authenticator
+	// TokenKey signs login tokens. Defaults to a random key, so tokens stop
+	// working when the server restarts.
+	TokenKey []byte
+	// How long a login token is accepted. Defaults to 24 hours.
+	TokenLifetime time.Duration
+	// If set, Serve speaks TLS with this config. A client certificate that
+	// the config verifies, through ClientCAs, logs the client in as the
+	// certificate's common name, just like a token would.
+	TLSConfig *tls.Config
+	// Web origins, like "https://chat.example.com", whose pages may open a
+	// websocket to the server besides its own. "*" allows any origin.
+	AllowedOrigins []string
+	// Buffer sizes for each connection, in bytes. Zero uses the websocket
+	// library's default.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// Largest frame a client may send, in bytes. Clients sending more are
+	// disconnected. Defaults to 64 KiB.
+	MaxMessageSize int64
+	// Websocket subprotocols the server speaks, in order of preference.
+	// Defaults to comm.Subprotocol. Clients that ask for none are still
+	// accepted.
+	Subprotocols []string
+	// Rooms clients may join. If empty, joining any room creates it.
+	Rooms []string
+	// Rooms there may be at once. Joining a room that does not exist yet
+	// fails once there are this many. Defaults to 1000.
+	MaxRooms int
+	// Message of the day, sent to every client that joins
+	MOTD string
+	// Frames waiting to be written to each client, at most. Defaults to
+	// serverclient.DefaultQueueSize.
+	SendQueueSize int
+	// How long one write to a client may take before it is disconnected.
+	// Defaults to serverclient.DefaultWriteTimeout.
+	WriteTimeout time.Duration
+	// What happens when a client's send queue is full. Defaults to
+	// disconnecting the client.
+	SlowConsumer serverclient.SlowConsumerPolicy
+	// How often clients are pinged, and how long they have to answer before
+	// they are disconnected and leave their room. Default to
+	// util.DefaultPingInterval and util.DefaultPongTimeout.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// How fast clients may send chat messages
+	RateLimit RateLimit
+	// Usernames allowed to kick, ban and mute in each room. Operators
+	// listed under "*" moderate every room. Without an Authenticator or
+	// client certificates anyone can join under an operator's name.
+	Operators map[string][]string
+	// Bans keeps the rooms' bans. Defaults to a list kept in memory.
+	Bans BanList
+	// Serve Stats at /stats. With an Authenticator or client certificates,
+	// only clients that logged in may read them.
+	Stats bool
+}
+
+type Server struct {
+	// The fields Reload changes are guarded by optsMu
+	opts     Options
+	optsMu   sync.RWMutex
+	log      *log.Logger
+	upgrader websocket.Upgrader
+	tokenKey []byte
+
+	rooms   map[string]*Room
+	roomsMu sync.Mutex
+	// The epoch new rooms start at, past any epoch of a room that was
+	// removed, so that a client coming back never sees an epoch reused
+	nextEpoch uint64
+	// What the slow consumer policy did, over all clients
+	queueCounters serverclient.QueueCounters
+	floods        floodGuard
+
+	mu         sync.Mutex
+	httpServer *http.Server
+	// Closed when Shutdown starts. New clients are turned away from then on.
+	shuttingDown chan struct{}
+	shutdownOnce sync.Once
+	// Closed once the rooms' message loops should stop
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// setDefaults fills in the options that were left empty
+func (opts *Options) setDefaults() {
+	if opts.DefaultRoom == "" {
+		opts.DefaultRoom = comm.DefaultRoom
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	if opts.TokenLifetime <= 0 {
+		opts.TokenLifetime = defaultTokenLifetime
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = defaultMaxMessageSize
+	}
+	if opts.MaxRooms <= 0 {
+		opts.MaxRooms = defaultMaxRooms
+	}
+	if opts.SendQueueSize <= 0 {
+		opts.SendQueueSize = serverclient.DefaultQueueSize
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = serverclient.DefaultWriteTimeout
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = util.DefaultPingInterval
+	}
+	if opts.PongTimeout <= 0 {
+		opts.PongTimeout = util.DefaultPongTimeout
+	}
+	opts.RateLimit.setDefaults()
+}
+
+func New(opts Options) *Server {
+	opts.setDefaults()
+	if opts.Subprotocols == nil {
+		opts.Subprotocols = []string{comm.Subprotocol}
+	}
+	if opts.Bans == nil {
+		opts.Bans, _ = NewFileBanList("")
+	}
+	tokenKey := opts.TokenKey
+	if len(tokenKey) == 0 {
+		tokenKey = make([]byte, 32)
+		rand.Read(tokenKey)
+	}
+
+	s := &Server{
+		opts:         opts,
+		log:          opts.Logger,
+		tokenKey:     tokenKey,
+		rooms:        make(map[string]*Room),
+		shuttingDown: make(chan struct{}),
+		done:         make(chan struct{}),
+		floods:       floodGuard{senders: make(map[string]*sender)},
+	}
+	s.upgrader = s.newUpgrader()
+	return s
+}
+
+// Handler returns the chat server's routes so they can be served directly or
+// mounted under another mux.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.homePage)
+	mux.HandleFunc("/ws", s.handleConnections)
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.HandleFunc("/stats", s.handleStats)
+	return mux
+}
+
+// Serve accepts connections on the listener until Shutdown is called, at
+// which point it returns ErrServerClosed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.isShuttingDown() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.httpServer = &http.Server{Handler: s.Handler()}
+	httpServer := s.httpServer
+	s.mu.Unlock()
+
+	if s.opts.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.opts.TLSConfig)
+	}
+
+	err := httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops accepting new connections and tells every client that the
+// server is going away. It gives key exchanges that are under way until ctx
+// is done to finish, then closes every connection and stops all room message
+// loops.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		close(s.shuttingDown)
+	})
+
+	s.mu.Lock()
+	httpServer := s.httpServer
+	s.mu.Unlock()
+	// Websocket connections are hijacked, so this only stops the listener
+	// and waits for plain requests such as logins
+	var err error
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+	}
+
+	s.roomsMu.Lock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.roomsMu.Unlock()
+
+	for _, room := range rooms {
+		room.announceShutdown()
+	}
+	s.waitForKeyExchanges(ctx, rooms)
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	for _, room := range rooms {
+		room.disconnectAll()
+	}
+	return err
+}
+
+// waitForKeyExchanges returns once no room has a key exchange under way, or
+// when ctx is done
+func (s *Server) waitForKeyExchanges(ctx context.Context, rooms []*Room) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := 0
+		for _, room := range rooms {
+			pending += room.pendingKeyExchanges()
+		}
+		if pending == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.log.Printf("Shutting down with %d key exchanges unfinished\n", pending)
+			return
+		}
+	}
+}
+
+// sendShutdown turns away a client that tries to join during shutdown
+func sendShutdown(client *serverclient.Client, id string) {
+	client.SendFrame(id, &comm.Shutdown{Message: shutdownMessage})
+	client.Close(websocket.CloseGoingAway, shutdownMessage)
+}
+
+func (s *Server) isShuttingDown() bool {
+	select {
+	case <-s.shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reload applies the options that can change while the server runs:
+// AllowedOrigins, MaxMessageSize, TokenLifetime, Rooms, MaxRooms, MOTD, the
+// send queue settings, the heartbeat, RateLimit, Operators and Stats. The
+// other fields of opts are ignored. Connected clients stay connected, but a
+// new MaxMessageSize, send queue setting or heartbeat only applies to new
+// connections. Clients already in a room that is no longer listed may stay
+// there, and rooms over a lower MaxRooms stay until they are empty. Turning
+// Stats off hides /stats right away.
+func (s *Server) Reload(opts Options) {
+	opts.setDefaults()
+	s.optsMu.Lock()
+	defer s.optsMu.Unlock()
+	s.opts.AllowedOrigins = opts.AllowedOrigins
+	s.opts.MaxMessageSize = opts.MaxMessageSize
+	s.opts.TokenLifetime = opts.TokenLifetime
+	s.opts.Rooms = opts.Rooms
+	s.opts.MaxRooms = opts.MaxRooms
+	s.opts.MOTD = opts.MOTD
+	s.opts.SendQueueSize = opts.SendQueueSize
+	s.opts.WriteTimeout = opts.WriteTimeout
+	s.opts.SlowConsumer = opts.SlowConsumer
+	s.opts.PingInterval = opts.PingInterval
+	s.opts.PongTimeout = opts.PongTimeout
+	s.opts.RateLimit = opts.RateLimit
+	s.opts.Operators = opts.Operators
+	s.opts.Stats = opts.Stats
+}
+
+// options returns the current options, including the changes made by Reload
+func (s *Server) options() Options {
+	s.optsMu.RLock()
+	defer s.optsMu.RUnlock()
+	return s.opts
+}
+
+// roomAllowed reports whether clients may join the named room
+func (s *Server) roomAllowed(name string) bool {
+	rooms := s.options().Rooms
+	if len(rooms) == 0 {
+		return true
+	}
+	for _, room := range rooms {
+		if room == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getRoom returns the room with the given name, creating it and starting its
+// message loop if it does not exist yet. It returns errShuttingDown once the
+// server is shutting down, and errTooManyRooms if the room would be one too
+// many.
+func (s *Server) getRoom(name string) (*Room, error) {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	if s.isShuttingDown() {
+		return nil, errShuttingDown
+	}
+	room, ok := s.rooms[name]
+	if !ok {
+		if len(s.rooms) >= s.options().MaxRooms {
+			return nil, errTooManyRooms
+		}
+		room = newRoom(s, name, s.nextEpoch)
+		s.rooms[name] = room
+		go room.handleMessages()
+		go room.watchIdle()
+		s.log.Printf("Room %q created\n", name)
+	}
+	return room, nil
+}
+
+// removeIfEmpty removes room once nobody is left in it, so that rooms made
+// up on the spot do not pile up. Joining it again creates it anew.
+func (s *Server) removeIfEmpty(room *Room) {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.removed || !room.isEmpty() {
+		return
+	}
+	room.removed = true
+	close(room.closed)
+	delete(s.rooms, room.Name)
+	s.nextEpoch = max(s.nextEpoch, room.epoch+1)
+	s.log.Printf("Room %q removed\n", room.Name)
+}
+
+// checkRoomName says why a room name cannot be used, or returns nil if it can.
+// Room names are shown the same way usernames are, so the same rules apply.
+func checkRoomName(name string) error {
+	return checkName("room names", name, maxRoomNameLength)
+}
+
+func (s *Server) homePage(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "Pablo")
+}
+
+// readJoin reads the Join that starts every connection, and negotiates the
+// protocol version. It returns the join's request id, which the reply must
+// carry.
+func readJoin(client *serverclient.Client) (string, *comm.Join, error) {
+	id, msg, err := client.ReadFrame()
+	var badFrame *serverclient.BadFrameError
+	if errors.As(err, &badFrame) {
+		client.SendFrame(id, badFrame.Reply)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	join, ok := msg.(*comm.Join)
+	if !ok {
+		client.SendError(id, comm.ErrCodeBadRequest, "expected join")
+		return "", nil, errors.New("invalid join message")
+	}
+
+	version, ok := comm.NegotiateVersion(join.Versions)
+	if !ok {
+		client.SendError(id, comm.ErrCodeUnsupportedVersion, fmt.Sprintf("server supports protocol versions %v", comm.SupportedVersions))
+		return "", nil, errors.New("no common protocol version")
+	}
+	err = checkUsername(join.Username)
+	if err != nil {
+		client.SendError(id, comm.ErrCodeUsernameInvalid, err.Error())
+		return "", nil, fmt.Errorf("invalid username %q: %w", join.Username, err)
+	}
+	if isReserved(join.Username) {
+		client.SendError(id, comm.ErrCodeUsernameReserved, fmt.Sprintf("%s is reserved", join.Username))
+		return "", nil, fmt.Errorf("reserved username %q", join.Username)
+	}
+	client.Version = version
+	return id, join, nil
+}
+
+// certificateUser returns the username in the client certificate, if the
+// client presented one that was verified
+func certificateUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// handleConnections runs a client's whole session on one websocket: the join,
+// the key exchange with the key hub and then the chat itself.
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if s.isShuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Check the certificate or token before upgrading, so that strangers
+	// never get a websocket
+	authenticatedAs := certificateUser(r)
+	if authenticatedAs == "" && s.opts.Authenticator != nil {
+		username, err := s.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		authenticatedAs = username
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Println("handle connections:", err)
+		return
+	}
+	opts := s.options()
+	conn.SetReadLimit(opts.MaxMessageSize)
+	client := serverclient.New(conn, serverclient.Options{
+		QueueSize:    opts.SendQueueSize,
+		WriteTimeout: opts.WriteTimeout,
+		Policy:       opts.SlowConsumer,
+		Counters:     &s.queueCounters,
+		PingInterval: opts.PingInterval,
+		PongTimeout:  opts.PongTimeout,
+	})
+	// Lets the frames queued so far, such as a rejection, go out first
+	defer client.Close(websocket.CloseNormalClosure, "")
+
+	joinId, joinMessage, err := readJoin(client)
+	if err != nil {
+		s.log.Println("handle connections:", err)
+		return
+	}
+	if authenticatedAs != "" && joinMessage.Username != authenticatedAs {
+		client.SendError(joinId, comm.ErrCodeUnauthorized, fmt.Sprintf("logged in as %s", authenticatedAs))
+		s.log.Printf("handle connections: %q tried to join as %q\n", authenticatedAs, joinMessage.Username)
+		return
+	}
+	client.Username = joinMessage.Username
+	client.Session = joinMessage.Session
+	client.Addr, _, _ = net.SplitHostPort(r.RemoteAddr)
+
+	roomName := joinMessage.Room
+	if roomName == "" {
+		roomName = s.opts.DefaultRoom
+	}
+	err = checkRoomName(roomName)
+	if err != nil {
+		client.SendError(joinId, comm.ErrCodeBadRequest, err.Error())
+		s.log.Printf("handle connections: %q tried to join room %q: %v\n", client.Username, roomName, err)
+		return
+	}
+	if !s.roomAllowed(roomName) {
+		client.SendError(joinId, comm.ErrCodeNoSuchRoom, fmt.Sprintf("there is no room %s", roomName))
+		s.log.Printf("handle connections: %q tried to join unknown room %q\n", client.Username, roomName)
+		return
+	}
+
+	banned, err := s.checkBan(roomName, client)
+	if err != nil {
+		s.log.Println("handle connections:", err)
+		client.SendError(joinId, comm.ErrCodeInternal, "could not check the ban list")
+		return
+	}
+	if banned != "" {
+		client.SendError(joinId, comm.ErrCodeBanned, banned)
+		s.log.Printf("handle connections: %q is %s\n", client.Username, banned)
+		return
+	}
+
+	var room *Room
+	for {
+		room, err = s.getRoom(roomName)
+		if errors.Is(err, errTooManyRooms) {
+			client.SendError(joinId, comm.ErrCodeTooManyRooms, fmt.Sprintf("there are too many rooms to create %s", roomName))
+			s.log.Printf("handle connections: %q could not create room %q: %v\n", client.Username, roomName, err)
+			return
+		}
+		if err != nil {
+			sendShutdown(client, joinId)
+			return
+		}
+		err = room.join(client, joinId, joinMessage)
+		// The room may have been removed since we got it
+		if !errors.Is(err, errRoomRemoved) {
+			break
+		}
+	}
+	if err != nil {
+		s.log.Println("handle connections:", err)
+		return
+	}
+	defer room.leave(client)
+	s.floods.connect(client.Username)
+	defer s.floods.disconnect(client.Username)
+	// Each connection has its own rate limit, besides the one for its user
+	var bucket tokenBucket
+	if motd := opts.MOTD; motd != "" {
+		room.send(MessageEvent{message: &comm.Notice{Text: motd}, recipient: client})
+	}
+
+	for {
+		id, msg, err := client.ReadFrame()
+		var badFrame *serverclient.BadFrameError
+		if errors.As(err, &badFrame) {
+			if !s.rejectFrame(client, id, badFrame.Reply, &bucket) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				// The client left on purpose and will not resume
+				room.endSession(client)
+			}
+			return
+		}
+
+		switch msg.(type) {
+		case *comm.KeyOffer, *comm.KeyAccept, *comm.RoomKey:
+			// The frames of an exchange the client takes part in are not
+			// charged, or a key hub could not keep up with many members
+			// joining at once. Nor are those of an exchange called off while
+			// it was answering. Any other frame is.
+			err = room.relayKeyExchange(client, id, msg)
+			switch {
+			case errors.Is(err, errExchangeCancelled):
+				client.SendError(id, comm.ErrCodeBadRequest, err.Error())
+			case err != nil && !s.rejectFrame(client, id, &comm.Error{Code: comm.ErrCodeBadRequest, Message: err.Error()}, &bucket):
+				return
+			}
+			continue
+		}
+		// Answers to a new member asking for our chain are not charged
+		// either, or members of a busy room would be taken for flooding
+		_, isSenderKey := msg.(*comm.SenderKey)
+		if !isSenderKey || !room.takeOwed(client) {
+			switch s.checkFrame(client, id, msg, &bucket) {
+			case allow:
+			case disconnect:
+				return
+			default:
+				continue
+			}
+		}
+
+		switch msg.(type) {
+		case *comm.Text, *comm.Identity, *comm.SenderKey, *comm.History, *comm.Who, *comm.Moderate:
+			if !room.isMember(client) {
+				client.SendError(id, comm.ErrCodeNotMember, "waiting for the room key")
+				continue
+			}
+		}
+
+		switch msg := msg.(type) {
+		case *comm.Text:
+			if left, muted := room.mutedFor(client.Username); muted {
+				message := "muted by an operator"
+				if left > 0 {
+					message += fmt.Sprintf(" for %s more", left.Round(time.Second))
+				}
+				client.SendError(id, comm.ErrCodeMuted, message)
+				continue
+			}
+			msg.Username = client.Username
+			room.touch(client)
+			if msg.To != "" {
+				room.sendPrivate(client, id, msg)
+				continue
+			}
+			room.record(msg)
+			room.send(MessageEvent{message: msg, client: client})
+		case *comm.Identity:
+			room.announceIdentity(client, msg)
+		case *comm.SenderKey:
+			// Encrypted with the room key, so we just pass it on. The first
+			// announcement of each chain is stored too, since the messages
+			// after it cannot be read without it.
+			msg.Username = client.Username
+			room.recordSenderKey(msg)
+			room.send(MessageEvent{message: msg, client: client})
+		case *comm.History:
+			room.sendHistory(client, id, msg.Limit)
+		case *comm.Who:
+			room.sendMembers(client, id)
+		case *comm.Moderate:
+			room.moderate(client, id, msg)
+		default:
+			client.SendError(id, comm.ErrCodeBadRequest, fmt.Sprintf("%s is not allowed here", msg.Kind()))
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"websocket-chat/client/chatclient"
+	"websocket-chat/comm"
+)
+
+// startServer serves a chat server with opts until the test ends
+func startServer(t *testing.T, opts Options) (*Server, chatclient.Config) {
+	t.Helper()
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	server := New(opts)
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+
+	host, port, err := net.SplitHostPort(httpServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, chatclient.Config{Host: host, Port: portNumber, DisableReconnect: true}
+}
+
+// dial joins the room in cfg as username and closes the client when the test
+// ends
+func dial(t *testing.T, cfg chatclient.Config, username string) (*chatclient.Client, error) {
+	t.Helper()
+	cfg.Username = username
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := chatclient.Dial(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, nil
+}
+
+// eventually fails the test unless ok becomes true within a few seconds
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting until", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *Server) hasRoom(name string) bool {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	return s.rooms[name] != nil
+}
+
+func TestEmptyRoomIsRemoved(t *testing.T) {
+	server, cfg := startServer(t, Options{MaxRooms: 1})
+	cfg.Room = "first"
+	alice, err := dial(t, cfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.hasRoom("first") {
+		t.Fatal("room was not created")
+	}
+
+	// There is only room for one room
+	cfg.Room = "second"
+	_, err = dial(t, cfg, "bob")
+	var rejection *comm.Error
+	if !errors.As(err, &rejection) || rejection.Code != comm.ErrCodeTooManyRooms {
+		t.Fatalf("joining a second room: got %v, want %s", err, comm.ErrCodeTooManyRooms)
+	}
+
+	alice.Close()
+	eventually(t, "the empty room is removed", func() bool { return !server.hasRoom("first") })
+	_, err = dial(t, cfg, "bob")
+	if err != nil {
+		t.Fatal("joining once the first room is gone:", err)
+	}
+}
+
+func TestLongRoomNameIsRejected(t *testing.T) {
+	server, cfg := startServer(t, Options{})
+	cfg.Room = strings.Repeat("r", maxRoomNameLength+1)
+	_, err := dial(t, cfg, "alice")
+	var rejection *comm.Error
+	if !errors.As(err, &rejection) || rejection.Code != comm.ErrCodeBadRequest {
+		t.Fatalf("got %v, want %s", err, comm.ErrCodeBadRequest)
+	}
+	if server.hasRoom(cfg.Room) {
+		t.Fatal("room was created")
+	}
+}
+
+func TestRoomNamesFollowUsernameRules(t *testing.T) {
+	server, cfg := startServer(t, Options{})
+	for _, name := range []string{" general", "general ", "gen\neral", "gen\u200beral", "gen\x1b[31meral"} {
+		cfg.Room = name
+		_, err := dial(t, cfg, "alice")
+		var rejection *comm.Error
+		if !errors.As(err, &rejection) || rejection.Code != comm.ErrCodeBadRequest {
+			t.Fatalf("joining %q: got %v, want %s", name, err, comm.ErrCodeBadRequest)
+		}
+		if server.hasRoom(name) {
+			t.Fatalf("room %q was created", name)
+		}
+	}
+}
+
+func TestJoinSendAndReceive(t *testing.T) {
+	// Two servers in one process do not share anything
+	server, cfg := startServer(t, Options{})
+	other, otherCfg := startServer(t, Options{})
+
+	alice, err := join(t, cfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := join(t, cfg, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Members only get messages from each other once they have each
+	// other's sender chains
+	introduced := func() bool { return server.roomState("general").unseenChains == 0 }
+	eventually(t, "alice and bob have each other's chains", introduced)
+	carol, err := join(t, otherCfg, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = alice.client.Send("hello bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "bob reads alice", func() bool { return bob.hasReceived("alice: hello bob") })
+	err = bob.client.Send("hello alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "alice reads bob", func() bool { return alice.hasReceived("bob: hello alice") })
+
+	// A private message only reaches bob. Messages from alice arrive in the
+	// order she sent them, so once dave has the next one he would have had it.
+	dave, err := join(t, cfg, "dave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "dave has everyone's chains", introduced)
+	err = alice.client.SendTo("bob", "just for you")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.client.Send("hello everyone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "bob reads the private message", func() bool { return bob.hasReceived("alice: just for you") })
+	eventually(t, "dave reads alice", func() bool { return dave.hasReceived("alice: hello everyone") })
+	if dave.hasReceived("alice: just for you") {
+		t.Fatal("dave got the private message")
+	}
+
+	if carol.hasReceived("alice: hello bob") || carol.hasReceived("bob: hello alice") {
+		t.Fatal("a message reached the other server")
+	}
+	if members := server.roomState("general").members; len(members) != 3 {
+		t.Fatalf("members are %v, want alice, bob and dave", members)
+	}
+	if members := other.roomState("general").members; len(members) != 1 || !members["carol"] {
+		t.Fatalf("members of the other server are %v, want carol", members)
+	}
+}
@@ -0,0 +1,62 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Stats is a snapshot of the server's clients and their send queues
+type Stats struct {
+	Rooms   int `json:"rooms"`
+	Clients int `json:"clients"`
+	// Frames waiting to be written, over all clients
+	Queued int `json:"queued"`
+	// The longest send queue
+	MaxQueued int `json:"max_queued"`
+	// Frames dropped by the drop-oldest policy since the server started
+	Dropped uint64 `json:"dropped"`
+	// Clients disconnected for being too slow since the server started
+	SlowDisconnects uint64 `json:"slow_disconnects"`
+}
+
+func (s *Server) Stats() Stats {
+	s.roomsMu.Lock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.roomsMu.Unlock()
+
+	stats := Stats{
+		Rooms:           len(rooms),
+		Dropped:         s.queueCounters.Dropped.Load(),
+		SlowDisconnects: s.queueCounters.Disconnected.Load(),
+	}
+	for _, room := range rooms {
+		for _, client := range room.everyone() {
+			queued := client.Queued()
+			stats.Clients++
+			stats.Queued += queued
+			stats.MaxQueued = max(stats.MaxQueued, queued)
+		}
+	}
+	return stats
+}
+
+// handleStats serves Stats as JSON for monitoring, if Options.Stats is set
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !s.options().Stats {
+		http.NotFound(w, r)
+		return
+	}
+	if certificateUser(r) == "" && s.opts.Authenticator != nil {
+		_, err := s.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Stats())
+}
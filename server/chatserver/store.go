@@ -0,0 +1,299 @@
+package chatserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"websocket-chat/comm"
+)
+
+// How many messages a history request returns when it does not say, and the
+// most it can ask for
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// A MessageStore keeps the messages relayed in each room so that clients can
+// fetch what was said before they joined. Messages are stored as the
+// envelopes the server relayed, still encrypted with the senders' keys.
+type MessageStore interface {
+	Append(room string, envelope comm.Envelope) error
+	// Recent returns up to limit of the newest messages in room, oldest
+	// first, along with the sender keys needed to read them
+	Recent(room string, limit int) ([]comm.Envelope, error)
+}
+
+// FileStore is a MessageStore that appends each room's messages to its own
+// file, one JSON envelope per line.
+type FileStore struct {
+	dir string
+	// How many messages to keep per room, or 0 to keep them all
+	retention int
+	// Lines in each room's file, counted on the first append
+	counts map[string]int
+	mu     sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.New("Error creating history directory: " + err.Error())
+	}
+	return &FileStore{dir: dir, counts: make(map[string]int)}, nil
+}
+
+// SetRetention limits how many messages are kept for each room. Older ones
+// are dropped as new ones come in. 0 keeps everything.
+func (f *FileStore) SetRetention(messages int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.retention = max(messages, 0)
+	// Appends are only counted while there is a limit
+	clear(f.counts)
+}
+
+func (f *FileStore) path(room string) string {
+	return filepath.Join(f.dir, url.PathEscape(room)+".jsonl")
+}
+
+func (f *FileStore) Append(room string, envelope comm.Envelope) error {
+	line, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path(room), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil || f.retention == 0 {
+		return err
+	}
+
+	count, ok := f.counts[room]
+	if !ok {
+		lines, err := f.readLines(room, 0)
+		if err != nil {
+			return err
+		}
+		count = len(lines)
+	} else {
+		count++
+	}
+	f.counts[room] = count
+	// Let the file grow by half before trimming, so it is not rewritten on
+	// every message
+	if count > f.retention+f.retention/2 {
+		return f.trim(room)
+	}
+	return nil
+}
+
+// trim must be called with f.mu held. It rewrites a room's file with only
+// its newest messages.
+func (f *FileStore) trim(room string) error {
+	lines, err := f.readLines(room, f.retention)
+	if err != nil {
+		return err
+	}
+	err = atomicWriteFile(f.path(room), func(w io.Writer) error {
+		for _, line := range lines {
+			_, err := w.Write(append(line, '\n'))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.counts[room] = len(lines)
+	return nil
+}
+
+func (f *FileStore) Recent(room string, limit int) ([]comm.Envelope, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	f.mu.Lock()
+	lines, err := f.readLines(room, limit)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	envelopes := make([]comm.Envelope, 0, len(lines))
+	for _, line := range lines {
+		var envelope comm.Envelope
+		err = json.Unmarshal(line, &envelope)
+		if err != nil {
+			// Skip a line that was only partly written
+			continue
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	return envelopes, nil
+}
+
+// readLines must be called with f.mu held. It returns the last limit lines
+// of a room's file, or all of them if limit is 0. Older sender keys are
+// returned too, ahead of those lines, when messages among them were sent
+// with the chains they announce. Sender keys whose messages are all older
+// are left out.
+//
+// The file is read from its end, so that only the lines returned and the
+// ones between them and the sender keys they need are read, however long
+// the history has grown.
+func (f *FileStore) readLines(room string, limit int) ([][]byte, error) {
+	file, err := os.Open(f.path(room))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Newest first until they are put in order at the end
+	var lines [][]byte
+	// Chains that messages in lines were sent with, but which no sender key
+	// in lines announces, and the oldest epoch among them
+	var needed map[storedChain]bool
+	var oldestEpoch uint64
+	err = readBackwards(file, func(line []byte) bool {
+		if limit == 0 || len(lines) < limit {
+			lines = append(lines, line)
+			return true
+		}
+		if needed == nil {
+			needed = neededChains(lines)
+			oldestEpoch = ^uint64(0)
+			for chain := range needed {
+				oldestEpoch = min(oldestEpoch, chain.epoch)
+			}
+		}
+		if len(needed) == 0 {
+			return false
+		}
+
+		kind, chain := parseLine(line)
+		switch kind {
+		case comm.KindSenderKey:
+			if needed[chain] {
+				lines = append(lines, line)
+				delete(needed, chain)
+			}
+		case comm.KindText:
+		default:
+			return true
+		}
+		// Members move on to a new epoch together, so there is no need to
+		// look further back than the one before the oldest needed
+		return chain.epoch+1 >= oldestEpoch
+	})
+	slices.Reverse(lines)
+	return lines, err
+}
+
+// neededChains returns the chains that messages in lines, newest first, were
+// sent with but that no sender key before them in lines announces
+func neededChains(lines [][]byte) map[storedChain]bool {
+	needed := make(map[storedChain]bool)
+	announced := make(map[storedChain]bool)
+	for i := len(lines) - 1; i >= 0; i-- {
+		kind, chain := parseLine(lines[i])
+		switch kind {
+		case comm.KindSenderKey:
+			announced[chain] = true
+		case comm.KindText:
+			if !announced[chain] {
+				needed[chain] = true
+			}
+		}
+	}
+	return needed
+}
+
+// readBackwards calls line with each non-empty line of file, starting with
+// the last one, until it returns false
+func readBackwards(file *os.File, line func([]byte) bool) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	const chunkSize = 64 * 1024
+	position := info.Size()
+	var partial []byte
+	for position > 0 {
+		n := min(chunkSize, position)
+		position -= n
+		chunk := make([]byte, n, int(n)+len(partial))
+		_, err = file.ReadAt(chunk, position)
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, partial...)
+		for {
+			i := bytes.LastIndexByte(chunk, '\n')
+			if i < 0 {
+				break
+			}
+			next := chunk[i+1 : len(chunk) : len(chunk)]
+			chunk = chunk[:i]
+			if len(next) > 0 && !line(next) {
+				return nil
+			}
+		}
+		partial = chunk
+	}
+	if len(partial) > 0 {
+		line(partial)
+	}
+	return nil
+}
+
+// A storedChain is the sender and epoch a stored message or sender key
+// belongs to
+type storedChain struct {
+	username string
+	epoch    uint64
+}
+
+// parseLine returns the kind of a stored envelope and, for messages and
+// sender keys, the chain it belongs to. Lines that cannot be read have no
+// kind.
+func parseLine(line []byte) (comm.Kind, storedChain) {
+	var envelope comm.Envelope
+	err := json.Unmarshal(line, &envelope)
+	if err != nil {
+		return "", storedChain{}
+	}
+	msg, err := comm.Decode(&envelope)
+	if err != nil {
+		return "", storedChain{}
+	}
+	switch msg := msg.(type) {
+	case *comm.Text:
+		return envelope.Kind, storedChain{username: msg.Username, epoch: msg.Epoch}
+	case *comm.SenderKey:
+		return envelope.Kind, storedChain{username: msg.Username, epoch: msg.Epoch}
+	}
+	return envelope.Kind, storedChain{}
+}
@@ -0,0 +1,100 @@
+package chatserver
+
+import (
+	"strings"
+	"testing"
+	"websocket-chat/comm"
+)
+
+func appendMessage(t *testing.T, store *FileStore, msg comm.Message) {
+	t.Helper()
+	envelope, err := comm.Encode(comm.ProtocolVersion, "", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Append("general", envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recentKinds(t *testing.T, store *FileStore, limit int) []string {
+	t.Helper()
+	envelopes, err := store.Recent("general", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for i := range envelopes {
+		msg, err := comm.Decode(&envelopes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg := msg.(type) {
+		case *comm.SenderKey:
+			kinds = append(kinds, "key:"+msg.Username)
+		case *comm.Text:
+			kinds = append(kinds, "text:"+msg.Username)
+		}
+	}
+	return kinds
+}
+
+func TestFileStoreKeepsSenderKeysOfKeptMessages(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetRetention(4)
+
+	appendMessage(t, store, &comm.SenderKey{Username: "alice", Epoch: 1, Chain: "a"})
+	appendMessage(t, store, &comm.SenderKey{Username: "bob", Epoch: 1, Chain: "b"})
+	appendMessage(t, store, &comm.Text{Username: "bob", Epoch: 1})
+	for range 4 {
+		appendMessage(t, store, &comm.Text{Username: "alice", Epoch: 1})
+	}
+
+	// Bob's key goes with his message, but Alice's is still needed
+	want := []string{"key:alice", "text:alice", "text:alice", "text:alice", "text:alice"}
+	got := recentKinds(t, store, 10)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	// A history request for fewer messages gets the key too
+	got = recentKinds(t, store, 2)
+	if len(got) != 3 || got[0] != "key:alice" {
+		t.Fatalf("got %v, want the key ahead of two messages", got)
+	}
+}
+
+func TestFileStoreReadsLongHistoryFromTheEnd(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendMessage(t, store, &comm.SenderKey{Username: "alice", Epoch: 1, Chain: "a"})
+	// Far more than one chunk of the file
+	ciphertext := strings.Repeat("x", 200)
+	for range 2000 {
+		appendMessage(t, store, &comm.Text{Username: "alice", Epoch: 1, Ciphertext: ciphertext})
+	}
+	appendMessage(t, store, &comm.SenderKey{Username: "bob", Epoch: 2, Chain: "b"})
+	appendMessage(t, store, &comm.Text{Username: "bob", Epoch: 2, Ciphertext: ciphertext})
+
+	want := []string{"key:alice", "text:alice", "text:alice", "key:bob", "text:bob"}
+	got := recentKinds(t, store, 4)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
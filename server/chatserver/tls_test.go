@@ -0,0 +1,183 @@
+package chatserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"websocket-chat/client/chatclient"
+	"websocket-chat/util"
+)
+
+// A testCert is a certificate and its key, both also written to PEM files
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert issues a certificate for template, signed by parent, or self
+// signed if parent is nil
+func newTestCert(t *testing.T, name string, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	c := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".pem"), keyFile: filepath.Join(dir, name+".key")}
+	err = os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestPKI makes a CA, a server certificate for 127.0.0.1 and a client
+// certificate for alice
+func newTestPKI(t *testing.T) (ca, server, client *testCert) {
+	t.Helper()
+	ca = newTestCert(t, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server = newTestCert(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client = newTestCert(t, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	return ca, server, client
+}
+
+// startTLSServer serves a chat server with config until the test ends
+func startTLSServer(t *testing.T, config *tls.Config) chatclient.Config {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(Options{TLSConfig: config, Logger: log.New(io.Discard, "", 0)})
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	port := listener.Addr().(*net.TCPAddr).Port
+	return chatclient.Config{Host: "127.0.0.1", Port: port, DisableReconnect: true}
+}
+
+func serverConfig(t *testing.T, cert *testCert) *tls.Config {
+	t.Helper()
+	pair, err := tls.LoadX509KeyPair(cert.certFile, cert.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{pair}}
+}
+
+func clientConfig(t *testing.T, opts chatclient.TLSOptions) *tls.Config {
+	t.Helper()
+	config, err := chatclient.NewTLSConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestTLSPinnedCertificate(t *testing.T) {
+	ca, serverCert, _ := newTestPKI(t)
+	cfg := startTLSServer(t, serverConfig(t, serverCert))
+
+	// The pin alone is enough, without trusting the CA
+	cfg.TLS = clientConfig(t, chatclient.TLSOptions{Pins: []string{util.CertificatePin(serverCert.cert)}})
+	_, err := dial(t, cfg, "alice")
+	if err != nil {
+		t.Fatal("connecting with the right pin:", err)
+	}
+
+	cfg.TLS = clientConfig(t, chatclient.TLSOptions{Pins: []string{util.CertificatePin(ca.cert)}})
+	_, err = dial(t, cfg, "bob")
+	if err == nil {
+		t.Fatal("connected with the wrong pin")
+	}
+
+	// A trusted CA does not make up for a wrong pin either
+	cfg.TLS = clientConfig(t, chatclient.TLSOptions{CAFile: ca.certFile, Pins: []string{util.CertificatePin(ca.cert)}})
+	_, err = dial(t, cfg, "bob")
+	if err == nil {
+		t.Fatal("connected with a trusted CA but the wrong pin")
+	}
+}
+
+func TestTLSClientCertificateRequired(t *testing.T) {
+	ca, serverCert, clientCert := newTestPKI(t)
+	config := serverConfig(t, serverCert)
+	pool, err := util.LoadCertPool(ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg := startTLSServer(t, config)
+
+	cfg.TLS = clientConfig(t, chatclient.TLSOptions{CAFile: ca.certFile})
+	_, err = dial(t, cfg, "alice")
+	if err == nil {
+		t.Fatal("connected without a client certificate")
+	}
+
+	cfg.TLS = clientConfig(t, chatclient.TLSOptions{CAFile: ca.certFile, CertFile: clientCert.certFile, KeyFile: clientCert.keyFile})
+	client, err := dial(t, cfg, "alice")
+	if err != nil {
+		t.Fatal("connecting with a client certificate:", err)
+	}
+	if client.Username() != "alice" {
+		t.Fatalf("joined as %q, want alice", client.Username())
+	}
+}
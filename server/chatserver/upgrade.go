@@ -0,0 +1,44 @@
+package chatserver
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Largest frame a client may send unless Options.MaxMessageSize says
+// otherwise. Chat messages are far smaller; this leaves room for long ones.
+const defaultMaxMessageSize = 64 * 1024
+
+func (s *Server) newUpgrader() websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  s.opts.ReadBufferSize,
+		WriteBufferSize: s.opts.WriteBufferSize,
+		Subprotocols:    s.opts.Subprotocols,
+		CheckOrigin:     s.checkOrigin,
+	}
+}
+
+// checkOrigin lets browsers open a websocket only from the server's own
+// origin or one in Options.AllowedOrigins, so that other web pages cannot
+// talk to the server from a visitor's browser. Clients that are not browsers
+// send no Origin and are let through.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.options().AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	s.log.Printf("Rejected websocket from origin %q\n", origin)
+	return false
+}
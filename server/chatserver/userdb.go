@@ -0,0 +1,132 @@
+package chatserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Compared against when a user does not exist, so that unknown users take as
+// long to reject as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// FileUserDB is an Authenticator backed by a file of bcrypt hashed passwords,
+// one "username:hash" per line. Files made with "htpasswd -B" work too.
+type FileUserDB struct {
+	path   string
+	hashes map[string][]byte
+	mu     sync.RWMutex
+}
+
+// NewFileUserDB loads the users in path. A missing file is treated as an
+// empty database, which SetPassword creates.
+func NewFileUserDB(path string) (*FileUserDB, error) {
+	db := &FileUserDB{path: path}
+	err := db.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload reads the file again, picking up users added or removed by hand.
+// The users loaded before are kept if the file cannot be read.
+func (db *FileUserDB) Reload() error {
+	hashes := make(map[string][]byte)
+	file, err := os.Open(db.path)
+	if errors.Is(err, os.ErrNotExist) {
+		db.setHashes(hashes)
+		return nil
+	}
+	if err != nil {
+		return errors.New("Error opening user database: " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(entry, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("Error reading user database: %s:%d is not username:hash", db.path, line)
+		}
+		hashes[username] = []byte(hash)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return errors.New("Error reading user database: " + err.Error())
+	}
+	db.setHashes(hashes)
+	return nil
+}
+
+func (db *FileUserDB) setHashes(hashes map[string][]byte) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.hashes = hashes
+}
+
+func (db *FileUserDB) Authenticate(username string, password string) error {
+	db.mu.RLock()
+	hash, ok := db.hashes[username]
+	db.mu.RUnlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrInvalidCredentials
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+// SetPassword adds a user or changes their password, and saves the database
+func (db *FileUserDB) SetPassword(username string, password string) error {
+	if username == "" || strings.ContainsAny(username, ":\n") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.hashes[username] = hash
+	return db.save()
+}
+
+// save must be called with db.mu held
+func (db *FileUserDB) save() error {
+	usernames := make([]string, 0, len(db.hashes))
+	for username := range db.hashes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	err := atomicWriteFile(db.path, func(w io.Writer) error {
+		for _, username := range usernames {
+			_, err := fmt.Fprintf(w, "%s:%s\n", username, db.hashes[username])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.New("Error saving user database: " + err.Error())
+	}
+	return nil
+}
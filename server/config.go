@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"websocket-chat/comm"
+	serverclient "websocket-chat/server/serverClient"
+	"websocket-chat/util"
+)
+
+// Config is the server's configuration file. Every field can be left out.
+type Config struct {
+	// Address to listen on, like ":8080"
+	Listen      string   `json:"listen"`
+	DefaultRoom string   `json:"default_room"`
+	Rooms       []string `json:"rooms"`
+	MOTD        string   `json:"motd"`
+	// Web origins whose pages may connect, besides the server's own
+	AllowedOrigins []string `json:"allowed_origins"`
+	// Serve GET /stats. On servers with accounts, only to users that logged
+	// in.
+	Stats  bool `json:"stats"`
+	Limits struct {
+		MaxMessageSize int64 `json:"max_message_size"`
+		// Rooms there may be at once, when clients can create them
+		MaxRooms        int `json:"max_rooms"`
+		ReadBufferSize  int `json:"read_buffer"`
+		WriteBufferSize int `json:"write_buffer"`
+		// Frames waiting to be sent to each client, at most
+		SendQueue    int      `json:"send_queue"`
+		WriteTimeout duration `json:"write_timeout"`
+		// What to do with clients whose send queue is full: "disconnect",
+		// "drop-oldest" or "block"
+		SlowConsumer string `json:"slow_consumer"`
+		// How often clients are pinged, and how long they have to answer
+		PingInterval duration `json:"ping_interval"`
+		PongTimeout  duration `json:"pong_timeout"`
+	} `json:"limits"`
+	RateLimit struct {
+		// Frames each connection, and each username over all its
+		// connections, may send per second, and in a burst
+		MessagesPerSecond     float64 `json:"messages_per_second"`
+		Burst                 int     `json:"burst"`
+		UserMessagesPerSecond float64 `json:"user_messages_per_second"`
+		UserBurst             int     `json:"user_burst"`
+		// Longest message or sender key, in bytes of ciphertext
+		MaxMessageLength int `json:"max_message_length"`
+		// Messages over the limit before the sender is muted, for how long,
+		// and before it is disconnected
+		MuteAfter       int      `json:"mute_after"`
+		MuteFor         duration `json:"mute_for"`
+		DisconnectAfter int      `json:"disconnect_after"`
+	} `json:"rate_limit"`
+	Moderation struct {
+		// Operators of each room, with "*" for those of every room
+		Operators map[string][]string `json:"operators"`
+		// Where bans are kept, or empty to keep them in memory
+		BansFile string `json:"bans_file"`
+	} `json:"moderation"`
+	Auth struct {
+		UsersFile     string   `json:"users_file"`
+		TokenLifetime duration `json:"token_lifetime"`
+	} `json:"auth"`
+	TLS struct {
+		Cert              string `json:"cert"`
+		Key               string `json:"key"`
+		ClientCA          string `json:"client_ca"`
+		RequireClientCert bool   `json:"require_client_cert"`
+	} `json:"tls"`
+	Log struct {
+		// Where to write the log instead of stderr
+		File string `json:"file"`
+	} `json:"log"`
+	History struct {
+		Dir string `json:"dir"`
+		// Messages to keep per room, or 0 for all
+		Retention int `json:"retention"`
+	} `json:"history"`
+}
+
+// duration reads durations like "24h" from JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf(`%s is not a duration like "24h" or "90m"`, data)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultConfig() *Config {
+	config := &Config{Listen: ":8080", DefaultRoom: comm.DefaultRoom}
+	config.Limits.MaxMessageSize = 64 * 1024
+	config.Limits.MaxRooms = 1000
+	config.Limits.SendQueue = serverclient.DefaultQueueSize
+	config.Limits.WriteTimeout = duration(serverclient.DefaultWriteTimeout)
+	config.Limits.SlowConsumer = serverclient.Disconnect.String()
+	config.Limits.PingInterval = duration(util.DefaultPingInterval)
+	config.Limits.PongTimeout = duration(util.DefaultPongTimeout)
+	config.RateLimit.MessagesPerSecond = 5
+	config.RateLimit.Burst = 10
+	config.RateLimit.UserMessagesPerSecond = 10
+	config.RateLimit.UserBurst = 20
+	config.RateLimit.MaxMessageLength = 8 * 1024
+	config.RateLimit.MuteAfter = 5
+	config.RateLimit.MuteFor = duration(30 * time.Second)
+	config.RateLimit.DisconnectAfter = 20
+	config.Moderation.BansFile = "bans.json"
+	config.Auth.TokenLifetime = duration(24 * time.Hour)
+	config.History.Dir = "history"
+	return config
+}
+
+// loadConfig reads a config file over the defaults. Fields the file does not
+// know are an error, so that typos do not go unnoticed.
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+	if path == "" {
+		return config, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("Error reading config: " + err.Error())
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// validate returns every problem with the config, one per field
+func (c *Config) validate() error {
+	var problems []string
+	check := func(ok bool, field string, format string, args ...any) {
+		if !ok {
+			problems = append(problems, field+": "+fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Listen)
+	check(err == nil, "listen", "%q is not an address like \":8080\"", c.Listen)
+	check(c.DefaultRoom != "", "default_room", "must not be empty")
+	seen := make(map[string]bool)
+	for _, room := range c.Rooms {
+		check(room != "", "rooms", "room names must not be empty")
+		check(!seen[room], "rooms", "%q is listed twice", room)
+		seen[room] = true
+	}
+	check(len(c.Rooms) == 0 || seen[c.DefaultRoom], "default_room", "%q is not one of the rooms", c.DefaultRoom)
+	for _, origin := range c.AllowedOrigins {
+		check(origin == "*" || strings.Contains(origin, "://"), "allowed_origins", "%q is not an origin like \"https://chat.example.com\"", origin)
+	}
+	check(c.Limits.MaxMessageSize > 0, "limits.max_message_size", "must be more than 0, is %d", c.Limits.MaxMessageSize)
+	check(c.Limits.MaxRooms > 0, "limits.max_rooms", "must be more than 0, is %d", c.Limits.MaxRooms)
+	check(c.Limits.ReadBufferSize >= 0, "limits.read_buffer", "must not be negative")
+	check(c.Limits.WriteBufferSize >= 0, "limits.write_buffer", "must not be negative")
+	check(c.Limits.SendQueue > 0, "limits.send_queue", "must be more than 0, is %d", c.Limits.SendQueue)
+	check(c.Limits.WriteTimeout > 0, "limits.write_timeout", "must be more than 0")
+	_, err = serverclient.ParseSlowConsumerPolicy(c.Limits.SlowConsumer)
+	check(err == nil, "limits.slow_consumer", "%v", err)
+	check(c.Limits.PingInterval > 0, "limits.ping_interval", "must be more than 0")
+	check(c.Limits.PongTimeout > 0, "limits.pong_timeout", "must be more than 0")
+	check(c.RateLimit.MessagesPerSecond > 0, "rate_limit.messages_per_second", "must be more than 0")
+	check(c.RateLimit.Burst > 0, "rate_limit.burst", "must be more than 0")
+	check(c.RateLimit.UserMessagesPerSecond > 0, "rate_limit.user_messages_per_second", "must be more than 0")
+	check(c.RateLimit.UserBurst > 0, "rate_limit.user_burst", "must be more than 0")
+	check(c.RateLimit.MaxMessageLength > 0, "rate_limit.max_message_length", "must be more than 0")
+	check(c.RateLimit.MuteAfter > 0, "rate_limit.mute_after", "must be more than 0")
+	check(c.RateLimit.MuteFor > 0, "rate_limit.mute_for", "must be more than 0")
+	check(c.RateLimit.DisconnectAfter >= c.RateLimit.MuteAfter, "rate_limit.disconnect_after", "must not be less than mute_after")
+	for room, operators := range c.Moderation.Operators {
+		check(room == "*" || len(c.Rooms) == 0 || seen[room], "moderation.operators", "%q is not one of the rooms", room)
+		for _, operator := range operators {
+			check(operator != "", "moderation.operators", "usernames must not be empty")
+		}
+	}
+	check(c.Auth.TokenLifetime > 0, "auth.token_lifetime", "must be more than 0")
+	check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls", "cert and key must be set together")
+	check(c.TLS.ClientCA == "" || c.TLS.Cert != "", "tls.client_ca", "needs tls.cert and tls.key")
+	check(!c.TLS.RequireClientCert || c.TLS.ClientCA != "", "tls.require_client_cert", "needs tls.client_ca")
+	check(c.History.Retention >= 0, "history.retention", "must not be negative")
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// A setting is one field of the config as it is shown in reload logs
+type setting struct {
+	name  string
+	value string
+	// Whether a reload can apply it, or the server has to be restarted
+	live bool
+}
+
+func (c *Config) settings() []setting {
+	show := func(value any) string {
+		text, _ := json.Marshal(value)
+		return string(text)
+	}
+	return []setting{
+		{"listen", show(c.Listen), false},
+		{"default_room", show(c.DefaultRoom), false},
+		{"rooms", show(c.Rooms), true},
+		{"motd", show(c.MOTD), true},
+		{"allowed_origins", show(c.AllowedOrigins), true},
+		{"stats", show(c.Stats), true},
+		{"limits.max_message_size", show(c.Limits.MaxMessageSize), true},
+		{"limits.max_rooms", show(c.Limits.MaxRooms), true},
+		{"limits.read_buffer", show(c.Limits.ReadBufferSize), false},
+		{"limits.write_buffer", show(c.Limits.WriteBufferSize), false},
+		{"limits.send_queue", show(c.Limits.SendQueue), true},
+		{"limits.write_timeout", show(c.Limits.WriteTimeout), true},
+		{"limits.slow_consumer", show(c.Limits.SlowConsumer), true},
+		{"limits.ping_interval", show(c.Limits.PingInterval), true},
+		{"limits.pong_timeout", show(c.Limits.PongTimeout), true},
+		{"rate_limit.messages_per_second", show(c.RateLimit.MessagesPerSecond), true},
+		{"rate_limit.burst", show(c.RateLimit.Burst), true},
+		{"rate_limit.user_messages_per_second", show(c.RateLimit.UserMessagesPerSecond), true},
+		{"rate_limit.user_burst", show(c.RateLimit.UserBurst), true},
+		{"rate_limit.max_message_length", show(c.RateLimit.MaxMessageLength), true},
+		{"rate_limit.mute_after", show(c.RateLimit.MuteAfter), true},
+		{"rate_limit.mute_for", show(c.RateLimit.MuteFor), true},
+		{"rate_limit.disconnect_after", show(c.RateLimit.DisconnectAfter), true},
+		{"moderation.operators", show(c.Moderation.Operators), true},
+		{"moderation.bans_file", show(c.Moderation.BansFile), false},
+		{"auth.users_file", show(c.Auth.UsersFile), false},
+		{"auth.token_lifetime", show(c.Auth.TokenLifetime), true},
+		{"tls.cert", show(c.TLS.Cert), false},
+		{"tls.key", show(c.TLS.Key), false},
+		{"tls.client_ca", show(c.TLS.ClientCA), false},
+		{"tls.require_client_cert", show(c.TLS.RequireClientCert), false},
+		{"log.file", show(c.Log.File), true},
+		{"history.dir", show(c.History.Dir), false},
+		{"history.retention", show(c.History.Retention), true},
+	}
+}
+
+// diffConfig lists the settings that differ between two configs. Those a
+// reload cannot apply are listed in restart.
+func diffConfig(old *Config, new *Config) (applied []string, restart []string) {
+	oldSettings := old.settings()
+	for i, setting := range new.settings() {
+		if setting.value == oldSettings[i].value {
+			continue
+		}
+		change := fmt.Sprintf("%s: %s -> %s", setting.name, oldSettings[i].value, setting.value)
+		if setting.live {
+			applied = append(applied, change)
+		} else {
+			restart = append(restart, change)
+		}
+	}
+	return applied, restart
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"websocket-chat/server/chatserver"
+	serverclient "websocket-chat/server/serverClient"
+)
+
+// liveOptions are the server options a reload can change
+func liveOptions(config *Config) chatserver.Options {
+	// Already checked by validate
+	policy, _ := serverclient.ParseSlowConsumerPolicy(config.Limits.SlowConsumer)
+	return chatserver.Options{
+		Rooms:          config.Rooms,
+		MOTD:           config.MOTD,
+		AllowedOrigins: config.AllowedOrigins,
+		MaxMessageSize: config.Limits.MaxMessageSize,
+		MaxRooms:       config.Limits.MaxRooms,
+		TokenLifetime:  time.Duration(config.Auth.TokenLifetime),
+		SendQueueSize:  config.Limits.SendQueue,
+		WriteTimeout:   time.Duration(config.Limits.WriteTimeout),
+		SlowConsumer:   policy,
+		PingInterval:   time.Duration(config.Limits.PingInterval),
+		PongTimeout:    time.Duration(config.Limits.PongTimeout),
+		Operators:      config.Moderation.Operators,
+		Stats:          config.Stats,
+		RateLimit: chatserver.RateLimit{
+			Rate:             config.RateLimit.MessagesPerSecond,
+			Burst:            config.RateLimit.Burst,
+			UserRate:         config.RateLimit.UserMessagesPerSecond,
+			UserBurst:        config.RateLimit.UserBurst,
+			MaxMessageLength: config.RateLimit.MaxMessageLength,
+			MuteAfter:        config.RateLimit.MuteAfter,
+			MuteDuration:     time.Duration(config.RateLimit.MuteFor),
+			DisconnectAfter:  config.RateLimit.DisconnectAfter,
+		},
+	}
+}
+
+// openLog sends the log to path, or to stderr if path is empty. It returns
+// the file, which the caller closes once it is replaced.
+func openLog(path string) (*os.File, error) {
+	if path == "" {
+		log.SetOutput(os.Stderr)
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(file)
+	return file, nil
+}
+
+// A reloader reads the config again whenever the server gets SIGHUP, and
+// applies what can be changed without dropping anyone
+type reloader struct {
+	readConfig func() (*Config, error)
+	config     *Config
+	server     *chatserver.Server
+	users      *chatserver.FileUserDB
+	store      *chatserver.FileStore
+	logFile    *os.File
+}
+
+func (r *reloader) run() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		r.reload()
+	}
+}
+
+func (r *reloader) reload() {
+	config, err := r.readConfig()
+	if err != nil {
+		log.Printf("Reload rejected, keeping the running config. %s\n", err)
+		return
+	}
+
+	// The log is opened again even if it did not move, so that it can be
+	// rotated
+	logFile, err := openLog(config.Log.File)
+	if err != nil {
+		log.Println("reload: open log:", err)
+		config.Log.File = r.config.Log.File
+		logFile, _ = openLog(config.Log.File)
+	}
+	if r.logFile != nil {
+		r.logFile.Close()
+	}
+	r.logFile = logFile
+
+	if r.users != nil {
+		err = r.users.Reload()
+		if err != nil {
+			log.Println("reload:", err)
+		}
+	}
+	if r.store != nil {
+		r.store.SetRetention(config.History.Retention)
+	}
+	r.server.Reload(liveOptions(config))
+
+	applied, restart := diffConfig(r.config, config)
+	if len(applied) > 0 {
+		log.Printf("Reloaded config:\n  %s\n", strings.Join(applied, "\n  "))
+	} else {
+		log.Println("Reloaded config, nothing changed")
+	}
+	if len(restart) > 0 {
+		log.Printf("These changes need a restart and were not applied:\n  %s\n", strings.Join(restart, "\n  "))
+	}
+
+	// Remember what is really running
+	running := *config
+	running.Listen = r.config.Listen
+	running.DefaultRoom = r.config.DefaultRoom
+	running.Limits.ReadBufferSize = r.config.Limits.ReadBufferSize
+	running.Limits.WriteBufferSize = r.config.Limits.WriteBufferSize
+	running.Auth.UsersFile = r.config.Auth.UsersFile
+	running.TLS = r.config.TLS
+	running.History.Dir = r.config.History.Dir
+	running.Moderation.BansFile = r.config.Moderation.BansFile
+	r.config = &running
+}
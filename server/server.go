@@ -1,344 +1,276 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math/big"
-	"net/http"
-	"sync"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
-	"websocket-chat/comm"
+	"websocket-chat/server/chatserver"
 	serverclient "websocket-chat/server/serverClient"
 	"websocket-chat/util"
 
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
+	"golang.org/x/term"
 )
 
-type MessageEvent struct {
-	message   comm.Message
-	client    *serverclient.Client
-	recipient *serverclient.Client
-}
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-var (
-	clients         = make(map[*serverclient.Client]bool)
-	incomingClients = make(map[*serverclient.Client]bool)
-	ids             = make(map[string]*serverclient.Client)
-	broadcast       = make(chan MessageEvent)
-	P               = util.GeneratePrime()
-	G               = big.NewInt(2)
-	keyHub          *serverclient.Client
-	mu              sync.Mutex
-)
-
-func main() {
-	hostPort := flag.Int("port", 8080, "Server Port")
-	flag.Parse()
-	http.HandleFunc("/", homePage)
-	http.HandleFunc("/ws", handleConnections)
-	http.HandleFunc("/connect", handleJoin)
-	http.HandleFunc("/key-exchange", handleKeyExchange) // The key hub connects here to exchange keys with new clients
-
-	go handleMessages()
-
-	fmt.Printf("Server started on :%s\n", fmt.Sprint(*hostPort))
-	err := http.ListenAndServe(fmt.Sprintf(":%d", *hostPort), nil)
-	if err != nil {
-		panic("Error starting server: " + err.Error())
+// readPassword asks for a password without echoing it when stdin is a
+// terminal
+func readPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		return string(password), err
 	}
-}
-
-func setKeyHub(client *serverclient.Client) {
-	client.SetIsKeyHub(true)
-	keyHub = client
-}
-
-func chooseNewKeyHub() {
-	keyHub = nil
-	for c := range clients {
-		setKeyHub(c)
-		break
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
 	}
+	return strings.TrimRight(line, "\r\n"), nil
 }
 
-func homePage(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, "Pablo")
-}
-
-func negotiateKeys(newClient *serverclient.Client, keyHubConnection *websocket.Conn) error {
-	// Tell key hub and new client to exchange keys
-	// Receive P, G, public key from key hub
-	_, PBytes, err := keyHubConnection.ReadMessage()
+// serverTLSConfig loads the server's certificate and, for mutual TLS, the CAs
+// that client certificates must be signed by
+func serverTLSConfig(certFile, keyFile, clientCA string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		newError := errors.New("Error receiving P from key hub:" + err.Error())
-		newClient.Disconnect()
-		return newError
+		return nil, errors.New("Error loading TLS certificate: " + err.Error())
 	}
-
-	_, GBytes, err := keyHubConnection.ReadMessage()
-	if err != nil {
-		newError := errors.New("Error receiving G from key hub:" + err.Error())
-		newClient.Disconnect()
-		return newError
-	}
-
-	_, keyHubPubKeyBytes, err := keyHubConnection.ReadMessage()
-	if err != nil {
-		newError := errors.New("Error receiving key hub's public key:" + err.Error())
-		newClient.Disconnect()
-		return newError
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if clientCA != "" {
+		pool, err := util.LoadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 	}
 
-	// Send P, G, key hub's public key to new client
-	err = newClient.WriteBinaryMessage(PBytes)
-	if err != nil {
-		newClient.Disconnect()
-		newError := errors.New("Error sending P to new client:" + err.Error())
-		return newError
+	// Clients with self-signed certificates can pin this instead
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err == nil {
+		fmt.Println("TLS certificate pin:", util.CertificatePin(leaf))
 	}
+	return config, nil
+}
 
-	err = newClient.WriteBinaryMessage(GBytes)
+// How long clients get to finish their key exchanges when the server stops
+const shutdownTimeout = 10 * time.Second
+
+// stopOnSignal shuts the server down gracefully on SIGINT or SIGTERM. A second
+// signal stops it right away.
+func stopOnSignal(server *chatserver.Server, stopped chan struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	log.Println("Shutting down, signal again to stop now")
+	go func() {
+		<-signals
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
 	if err != nil {
-		newError := errors.New("Error sending G to new client:" + err.Error())
-		return newError
+		log.Println("shutdown:", err)
 	}
+	close(stopped)
+}
 
-	err = newClient.WriteBinaryMessage(keyHubPubKeyBytes)
+// addUser sets a user's password in the user database
+func addUser(users *chatserver.FileUserDB, username string) error {
+	password, err := readPassword(fmt.Sprintf("Password for %s: ", username))
 	if err != nil {
-		newError := errors.New("Error sending key hub's public key to new client:" + err.Error())
-		return newError
+		return err
 	}
-
-	// Each client sends its public key to the other
-	// Receive new client's public key
-
-	_, newClientPubKeyBytes, err := newClient.ReadMessage()
-	if err != nil {
-		newError := errors.New("Error receiving new client's public key:" + err.Error())
-		newClient.Disconnect()
-		return newError
+	if password == "" {
+		return errors.New("empty password")
 	}
+	return users.SetPassword(username, password)
+}
 
-	// Send new client's public key to key hub
-	serverclient.WriteBinaryMessage(keyHubConnection, newClientPubKeyBytes)
-	// Each client calculates the PSK
-
-	// Share room key with new client
-	serverclient.SendCommand(keyHubConnection, "share-room-key")
-	_, roomKey, err := keyHubConnection.ReadMessage()
-	if err != nil {
-		newError := errors.New("Error receiving room key from key hub:" + err.Error())
-		// keyHubConnection.Disconnect()
-		return newError
-	}
+func main() {
+	configFile := flag.String("config", "", "JSON config file. Flags given on the command line override it. SIGHUP reloads it")
+	hostPort := flag.Int("port", 8080, "Server Port")
+	historyDir := flag.String("history", "history", "Directory to keep chat history in, or empty to keep none")
+	usersFile := flag.String("users", "", "User database file. If set, clients must log in with a password")
+	newUser := flag.String("add-user", "", "Add a user to the -users database, or change their password, and exit")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file. Clients then connect with wss")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	clientCA := flag.String("tls-client-ca", "", "CA bundle for client certificates. Their common name is used as the username")
+	requireClientCert := flag.Bool("tls-require-client-cert", false, "Turn away clients without a certificate from -tls-client-ca")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma separated web origins, besides the server's own, whose pages may connect. \"*\" allows any")
+	maxMessageSize := flag.Int64("max-message-size", 64*1024, "Largest frame a client may send, in bytes")
+	maxRooms := flag.Int("max-rooms", 1000, "Rooms there may be at once. Joining a new room fails once there are this many")
+	readBufferSize := flag.Int("read-buffer", 0, "Read buffer size per connection, in bytes (0 for the default)")
+	writeBufferSize := flag.Int("write-buffer", 0, "Write buffer size per connection, in bytes (0 for the default)")
+	sendQueue := flag.Int("send-queue", serverclient.DefaultQueueSize, "Frames waiting to be sent to each client, at most")
+	writeTimeout := flag.Duration("write-timeout", serverclient.DefaultWriteTimeout, "How long one write to a client may take before it is disconnected")
+	pingInterval := flag.Duration("ping-interval", util.DefaultPingInterval, "How often clients are pinged to tell whether they are still there")
+	pongTimeout := flag.Duration("pong-timeout", util.DefaultPongTimeout, "How long a client has to answer a ping before it is disconnected")
+	rateLimit := flag.Float64("rate-limit", 5, "Frames each connection may send per second once it has joined")
+	maxMessageLength := flag.Int("max-message-length", 8*1024, "Longest chat message, in bytes once encrypted")
+	operators := flag.String("operators", "", "Comma separated usernames that may kick, ban and mute in every room")
+	bansFile := flag.String("bans", "bans.json", "File to keep bans in, or empty to forget them on restart")
+	stats := flag.Bool("stats", false, "Serve GET /stats. With -users or client certificates, only to users that logged in")
+	slowConsumer := flag.String("slow-consumer", "disconnect", "What to do when a client's send queue is full: disconnect, drop-oldest or block")
+	flag.Parse()
 
-	err = newClient.WriteBinaryMessage(roomKey)
-	if err != nil {
-		newError := errors.New("Error sending room key to new client:" + err.Error())
-		return newError
+	// The config file, with the flags that were given on top
+	readConfig := func() (*Config, error) {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "port":
+				config.Listen = fmt.Sprintf(":%d", *hostPort)
+			case "history":
+				config.History.Dir = *historyDir
+			case "users":
+				config.Auth.UsersFile = *usersFile
+			case "tls-cert":
+				config.TLS.Cert = *tlsCert
+			case "tls-key":
+				config.TLS.Key = *tlsKey
+			case "tls-client-ca":
+				config.TLS.ClientCA = *clientCA
+			case "tls-require-client-cert":
+				config.TLS.RequireClientCert = *requireClientCert
+			case "allowed-origins":
+				config.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+			case "max-message-size":
+				config.Limits.MaxMessageSize = *maxMessageSize
+			case "max-rooms":
+				config.Limits.MaxRooms = *maxRooms
+			case "read-buffer":
+				config.Limits.ReadBufferSize = *readBufferSize
+			case "write-buffer":
+				config.Limits.WriteBufferSize = *writeBufferSize
+			case "send-queue":
+				config.Limits.SendQueue = *sendQueue
+			case "write-timeout":
+				config.Limits.WriteTimeout = duration(*writeTimeout)
+			case "slow-consumer":
+				config.Limits.SlowConsumer = *slowConsumer
+			case "rate-limit":
+				config.RateLimit.MessagesPerSecond = *rateLimit
+			case "max-message-length":
+				config.RateLimit.MaxMessageLength = *maxMessageLength
+			case "operators":
+				if config.Moderation.Operators == nil {
+					config.Moderation.Operators = make(map[string][]string)
+				}
+				config.Moderation.Operators["*"] = strings.Split(*operators, ",")
+			case "stats":
+				config.Stats = *stats
+			case "bans":
+				config.Moderation.BansFile = *bansFile
+			case "ping-interval":
+				config.Limits.PingInterval = duration(*pingInterval)
+			case "pong-timeout":
+				config.Limits.PongTimeout = duration(*pongTimeout)
+			}
+		})
+		return config, config.validate()
 	}
-	newClient.DHDone = true
-	return nil
-}
-
-func handleKeyExchange(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	config, err := readConfig()
 	if err != nil {
-		fmt.Println("handle join:", err)
-		return
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	defer conn.Close()
 
-	mu.Lock()
-	var incomingClient *serverclient.Client
-	for client := range incomingClients {
-		if client.Conn == nil {
-			delete(incomingClients, client)
-		} else {
-			incomingClient = client
-			delete(incomingClients, client)
-			break
+	var users *chatserver.FileUserDB
+	if config.Auth.UsersFile != "" {
+		users, err = chatserver.NewFileUserDB(config.Auth.UsersFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
 	}
-	mu.Unlock()
-
-	err = negotiateKeys(incomingClient, conn)
-	if err != nil {
-		log.Println("handle key exchange:", err)
+	if *newUser != "" {
+		if users == nil {
+			fmt.Println("-add-user needs -users")
+			os.Exit(1)
+		}
+		err = addUser(users, *newUser)
+		if err != nil {
+			fmt.Println("Error adding user:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Saved %s to %s\n", *newUser, config.Auth.UsersFile)
 		return
 	}
-}
 
-func handleJoin(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	logFile, err := openLog(config.Log.File)
 	if err != nil {
-		fmt.Println("handle join:", err)
-		return
+		fmt.Println("Error opening log:", err)
+		os.Exit(1)
 	}
-	defer conn.Close()
-	client := &serverclient.Client{Conn: conn}
-	mu.Lock()
-	incomingClients[client] = true
-	mu.Unlock()
 
-	// Get client ID
-	var joinMessage comm.Message
-	err = client.Conn.ReadJSON(&joinMessage)
-	if err != nil {
-		log.Println("handle join: get id:", err)
-		client.Disconnect()
-		return
+	options := liveOptions(config)
+	options.DefaultRoom = config.DefaultRoom
+	options.ReadBufferSize = config.Limits.ReadBufferSize
+	options.WriteBufferSize = config.Limits.WriteBufferSize
+	if users != nil {
+		options.Authenticator = users
 	}
-
-	if joinMessage.Type == comm.Info && joinMessage.Message == "join" {
-		clientId := (*uuid.UUID)(joinMessage.Data)
-		clientIdString := clientId.String()
-		ids[clientIdString] = client
-		if keyHub == nil {
-			// This client is the key hub
-			err = ids[clientIdString].WriteJSON(comm.Message{Username: "server", Message: "kh-join-done", Type: comm.Info})
-			if err != nil {
-				log.Println("handle join: send join chat command:", err)
-				delete(ids, clientIdString)
-				return
-			}
-			ids[clientIdString].Conn = nil
-		} else {
-			// This client is not the key hub
-			err = ids[clientIdString].WriteJSON(comm.Message{Username: "server", Message: "cl", Type: comm.Info})
-			if err != nil {
-				log.Println("handle join: send join chat command:", err)
-				delete(ids, clientIdString)
-				return
-			}
+	if config.TLS.Cert != "" {
+		options.TLSConfig, err = serverTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA, config.TLS.RequireClientCert)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
 	}
-
-	// If there is a key hub, do key exchange
-	if keyHub != nil {
-		exchangeKeys := comm.Message{Username: "server", Message: "exchange-keys", Type: comm.Command}
-		messageEvent := MessageEvent{message: exchangeKeys, recipient: keyHub}
-		broadcast <- messageEvent
-
-		// Wait for client to finish key exchange
-		// This is done because the connection will close if this function
-		// returns. If it returns before the key exchange is done, the client
-		// will not be able to finish the key exchange
-		for {
-			if client.DHDone {
-				return
-			} else {
-				time.Sleep(100 * time.Millisecond)
-			}
+	var store *chatserver.FileStore
+	if config.History.Dir != "" {
+		store, err = chatserver.NewFileStore(config.History.Dir)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		store.SetRetention(config.History.Retention)
+		options.Store = store
 	}
-}
 
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	options.Bans, err = chatserver.NewFileBanList(config.Moderation.BansFile)
 	if err != nil {
-		fmt.Println("handle connections:", err)
-		return
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	defer conn.Close()
 
-	// Get client ID
-	var joinMessage comm.Message
-	err = conn.ReadJSON(&joinMessage)
+	listener, err := net.Listen("tcp", config.Listen)
 	if err != nil {
-		log.Println("handle connections: get id:", err)
-		conn.Close()
-		return
+		fmt.Println("Error starting server:", err)
+		os.Exit(1)
 	}
-	var clientId *uuid.UUID
-	if joinMessage.Type == comm.Info && joinMessage.Message == "join" {
-		clientId = (*uuid.UUID)(joinMessage.Data)
-	} else {
-		fmt.Println("Invalid join message")
-		return
-	}
-
-	clientIdString := clientId.String()
-	client := ids[clientIdString]
-	client.Conn = conn
-	clients[client] = true
-
-	if keyHub == nil {
-		mu.Lock()
-		delete(incomingClients, client)
-		mu.Unlock()
-		setKeyHub(client)
-		makeKeysMessage := comm.Message{Username: "server", Message: "generate-keys", Type: comm.Command}
-		messageEvent := MessageEvent{message: makeKeysMessage, recipient: keyHub}
-		broadcast <- messageEvent
-	} else {
-		// Send a message to key hub to open new connection?
-		// Make key hub channel for the new connection?
-		// newMessageForKeyHub := comm.Message{Username: "server", Message: "Ayo you are the key hub AND someone new has joined", Type: comm.Text}
-		// messageEvent := MessageEvent{message: newMessageForKeyHub, recipient: keyHub}
-		// broadcast <- messageEvent
-	}
-
-	for {
-		// listenMessages(conn, client)
-
-		var msg comm.Message
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			delete(clients, client)
-			delete(ids, clientIdString)
-			if client.IsKeyHub() {
-				// Choose new key hub
-				chooseNewKeyHub()
-			}
-			return
-		}
-
-		if msg.Type == comm.Text {
-			messageEvent := MessageEvent{message: msg, client: client}
-			broadcast <- messageEvent
-		}
 
-		if msg.Type == comm.Info {
-			if msg.Message == "ke" {
-				log.Println("Key hub needs to do a key exchange")
-				client.DHDone = false
-			}
-		}
-	}
-}
+	server := chatserver.New(options)
+	reloader := &reloader{readConfig: readConfig, config: config, server: server, users: users, store: store, logFile: logFile}
+	go reloader.run()
+	stopped := make(chan struct{})
+	go stopOnSignal(server, stopped)
 
-func handleMessages() {
-	for {
-		msgEvent := <-broadcast
-		if msgEvent.recipient != nil {
-			err := msgEvent.recipient.WriteJSON(msgEvent.message)
-			if err != nil {
-				fmt.Println("handle messages:", err)
-				msgEvent.recipient.Disconnect()
-				delete(clients, msgEvent.recipient)
-			}
-		} else {
-			for client := range clients {
-				var err error
-				if client != msgEvent.client {
-					err = client.WriteJSON(msgEvent.message)
-				}
-				if err != nil {
-					fmt.Println("handle messages:", err)
-					client.Disconnect()
-					delete(clients, client)
-				}
-			}
-		}
+	fmt.Printf("Server started on %s\n", config.Listen)
+	err = server.Serve(listener)
+	if errors.Is(err, chatserver.ErrServerClosed) {
+		<-stopped
+		return
 	}
+	fmt.Println("Error running server:", err)
+	os.Exit(1)
 }
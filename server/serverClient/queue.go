@@ -0,0 +1,154 @@
+package serverclient
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frames a client's send queue holds unless Options says otherwise
+const DefaultQueueSize = 256
+
+// How long a single write may take unless Options says otherwise
+const DefaultWriteTimeout = 10 * time.Second
+
+var (
+	// ErrClosed is returned for frames sent to a client that is closed or
+	// closing
+	ErrClosed = errors.New("serverclient: client closed")
+	// ErrSlowConsumer is returned when a client was disconnected because
+	// its send queue was full
+	ErrSlowConsumer = errors.New("serverclient: send queue full")
+)
+
+// SlowConsumerPolicy says what happens to a frame sent to a client whose send
+// queue is full
+type SlowConsumerPolicy int
+
+const (
+	// Disconnect the client. It can reconnect and resume its session.
+	Disconnect SlowConsumerPolicy = iota
+	// Drop the oldest frame in the queue to make room
+	DropOldest
+	// Wait for room in the queue. Everyone else in the room waits too, at
+	// most for the write timeout.
+	Block
+)
+
+var policyNames = map[SlowConsumerPolicy]string{
+	Disconnect: "disconnect",
+	DropOldest: "drop-oldest",
+	Block:      "block",
+}
+
+func (p SlowConsumerPolicy) String() string {
+	name, ok := policyNames[p]
+	if !ok {
+		return fmt.Sprintf("SlowConsumerPolicy(%d)", int(p))
+	}
+	return name
+}
+
+// ParseSlowConsumerPolicy reads a policy by the name String gives it
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	for policy, policyName := range policyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not one of disconnect, drop-oldest or block", name)
+}
+
+// QueueCounters add up what happened to the send queues of many clients
+type QueueCounters struct {
+	// Frames dropped by DropOldest
+	Dropped atomic.Uint64
+	// Clients disconnected by Disconnect
+	Disconnected atomic.Uint64
+}
+
+type frame struct {
+	messageType int
+	data        []byte
+}
+
+// enqueue queues a frame for the client's writer, applying the slow consumer
+// policy if the queue is full
+func (C *Client) enqueue(f frame) error {
+	if C.closing.Load() {
+		return ErrClosed
+	}
+	select {
+	case C.queue <- f:
+		return nil
+	case <-C.stop:
+		return ErrClosed
+	default:
+	}
+
+	switch C.opts.Policy {
+	case DropOldest:
+		for {
+			select {
+			case <-C.queue:
+				if C.opts.Counters != nil {
+					C.opts.Counters.Dropped.Add(1)
+				}
+			default:
+			}
+			select {
+			case C.queue <- f:
+				return nil
+			case <-C.stop:
+				return ErrClosed
+			default:
+			}
+		}
+	case Block:
+		select {
+		case C.queue <- f:
+			return nil
+		case <-C.stop:
+			return ErrClosed
+		}
+	default:
+		if C.opts.Counters != nil {
+			C.opts.Counters.Disconnected.Add(1)
+		}
+		C.Disconnect()
+		return ErrSlowConsumer
+	}
+}
+
+// writeLoop is the only goroutine that writes data frames to the connection
+func (C *Client) writeLoop() {
+	defer close(C.done)
+	for {
+		var f frame
+		select {
+		case f = <-C.queue:
+		case <-C.stop:
+			return
+		}
+
+		deadline := time.Now().Add(C.opts.WriteTimeout)
+		if f.messageType == websocket.CloseMessage {
+			C.Conn.WriteControl(websocket.CloseMessage, f.data, deadline)
+			return
+		}
+		C.Conn.SetWriteDeadline(deadline)
+		err := C.Conn.WriteMessage(f.messageType, f.data)
+		if err != nil {
+			C.Disconnect()
+			return
+		}
+	}
+}
+
+// Queued returns how many frames are waiting to be written to the client
+func (C *Client) Queued() int {
+	return len(C.queue)
+}
@@ -1,65 +1,175 @@
 package serverclient
 
 import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
 	"websocket-chat/comm"
+	"websocket-chat/util"
 
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
 	Conn     *websocket.Conn
-	isKeyHub bool
-	DHDone   bool
+	Username string
+	// Session id the client joined with, used to resume its membership if
+	// it reconnects
+	Session string
+	// Protocol version negotiated when the client joined
+	Version int
+	// IP address the client connected from
+	Addr string
+
+	// Frames waiting for writeLoop, which is the connection's only writer,
+	// so a slow client never holds up whoever sends to it
+	opts  Options
+	queue chan frame
+	// Set by Close, after which nothing more is queued
+	closing atomic.Bool
+	// Closed by Disconnect
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Closed when writeLoop returns
+	done chan struct{}
 }
 
-func (C *Client) ReadMessage() (messageType int, p []byte, err error) {
-	return C.Conn.ReadMessage()
+type Options struct {
+	// Frames the send queue holds. Defaults to DefaultQueueSize.
+	QueueSize int
+	// How long a single write may take before the client is disconnected.
+	// Defaults to DefaultWriteTimeout.
+	WriteTimeout time.Duration
+	Policy       SlowConsumerPolicy
+	// Where drops and disconnects are counted, if set
+	Counters *QueueCounters
+	// How often the client is pinged, and how long it has to answer before
+	// it is taken for dead. Default to util.DefaultPingInterval and
+	// util.DefaultPongTimeout.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
 }
 
-func (C *Client) WriteBinaryMessage(data []byte) error {
-	return C.Conn.WriteMessage(websocket.BinaryMessage, data)
+// New wraps conn, starts writing the frames sent to it and pinging the client
+func New(conn *websocket.Conn, opts Options) *Client {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = DefaultWriteTimeout
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = util.DefaultPingInterval
+	}
+	if opts.PongTimeout <= 0 {
+		opts.PongTimeout = util.DefaultPongTimeout
+	}
+	C := &Client{
+		Conn:  conn,
+		opts:  opts,
+		queue: make(chan frame, opts.QueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go C.writeLoop()
+	util.Heartbeat(conn, opts.PingInterval, opts.PongTimeout, C.stop)
+	return C
 }
 
 func (C *Client) WriteTextMessage(data []byte) error {
-	return C.Conn.WriteMessage(websocket.TextMessage, data)
+	return C.enqueue(frame{websocket.TextMessage, data})
 }
 
+// Disconnect closes the connection right away, dropping whatever is queued
 func (C *Client) Disconnect() {
+	C.stopOnce.Do(func() {
+		close(C.stop)
+	})
 	C.Conn.Close()
 }
 
-func (C *Client) WriteJSON(v interface{}) error {
-	return C.Conn.WriteJSON(v)
-}
-
-func (C *Client) SendCommand(command string) error {
-	return C.WriteJSON(comm.Message{Username: "server", Message: command, Type: comm.Command})
+// Close writes out what is queued, then a close frame saying why the
+// connection ends, and closes it. It gives up after the write timeout.
+func (C *Client) Close(code int, reason string) {
+	if C.closing.Swap(true) {
+		return
+	}
+	timeout := time.After(C.opts.WriteTimeout)
+	select {
+	case C.queue <- frame{websocket.CloseMessage, websocket.FormatCloseMessage(code, reason)}:
+		select {
+		case <-C.done:
+		case <-timeout:
+		}
+	case <-C.stop:
+	case <-timeout:
+	}
+	C.Disconnect()
 }
 
-func (C *Client) SendInfo(info string, data []byte) error {
-	return C.WriteJSON(comm.Message{Username: "server", Message: info, Type: comm.Info})
+func (C *Client) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return C.WriteTextMessage(data)
 }
 
-func (C *Client) SendText(text string) error {
-	return C.WriteJSON(comm.Message{Username: "server", Message: text, Type: comm.Text})
+// Send wraps msg in an envelope for the client's protocol version
+func (C *Client) Send(msg comm.Message) error {
+	return C.SendFrame("", msg)
 }
 
-func (C *Client) SetIsKeyHub(isKeyHub bool) {
-	C.isKeyHub = isKeyHub
+// SendFrame sends msg with a correlation id, such as the id of the request
+// it answers
+func (C *Client) SendFrame(id string, msg comm.Message) error {
+	version := C.Version
+	if version == 0 {
+		version = comm.ProtocolVersion
+	}
+	envelope, err := comm.Encode(version, id, msg)
+	if err != nil {
+		return err
+	}
+	return C.WriteJSON(envelope)
 }
 
-func (C *Client) IsKeyHub() bool {
-	return C.isKeyHub
+// ReadFrame returns the next typed message from the client along with its
+// correlation id. Frames that are not valid envelopes, use an unsupported
+// version or have an unknown kind give a *BadFrameError, after which the
+// caller may read on.
+func (C *Client) ReadFrame() (string, comm.Message, error) {
+	var envelope comm.Envelope
+	err := C.Conn.ReadJSON(&envelope)
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) || errors.As(err, &typeError) {
+		return "", nil, &BadFrameError{Reply: &comm.Error{Code: comm.ErrCodeBadRequest, Message: err.Error()}}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	msg, err := comm.Decode(&envelope)
+	if err != nil {
+		return envelope.Id, nil, &BadFrameError{Reply: comm.ErrorFor(err)}
+	}
+	return envelope.Id, msg, nil
 }
 
-func SendCommand(conn *websocket.Conn, command string) error {
-	return conn.WriteJSON(comm.Message{Username: "server", Message: command, Type: comm.Command})
+// A BadFrameError is a frame that is not a message we know. The connection
+// can still be used, and Reply is what to answer the frame with.
+type BadFrameError struct {
+	Reply *comm.Error
 }
 
-func WriteBinaryMessage(conn *websocket.Conn, data []byte) error {
-	return conn.WriteMessage(websocket.BinaryMessage, data)
+func (e *BadFrameError) Error() string {
+	return "bad frame: " + e.Reply.Message
 }
 
-func ReadMessage(conn *websocket.Conn) (messageType int, p []byte, err error) {
-	return conn.ReadMessage()
+// SendError rejects the request with the given id
+func (C *Client) SendError(id string, code string, message string) error {
+	return C.SendFrame(id, &comm.Error{Code: code, Message: message})
 }
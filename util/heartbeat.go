@@ -0,0 +1,42 @@
+package util
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Used by both ends unless configured otherwise
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultPongTimeout  = 15 * time.Second
+)
+
+// Heartbeat starts pinging the peer on conn every interval, until stop is
+// closed or a ping cannot be sent. Reads on conn fail once no pong has come
+// back for interval+timeout, so a peer that vanished without closing the
+// connection is noticed by whoever reads from it. Call it before reading from
+// conn starts.
+func Heartbeat(conn *websocket.Conn, interval time.Duration, timeout time.Duration, stop <-chan struct{}) {
+	conn.SetReadDeadline(time.Now().Add(interval + timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(interval + timeout))
+	})
+	go ping(conn, interval, timeout, stop)
+}
+
+func ping(conn *websocket.Conn, interval time.Duration, timeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+		if err != nil {
+			return
+		}
+	}
+}
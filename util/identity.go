@@ -0,0 +1,170 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	signedKeyContext    = "websocket-chat signed key v1"
+	safetyNumberContext = "websocket-chat safety number v1"
+)
+
+var ErrBadSignature = errors.New("signature does not match identity key")
+
+// An Identity is a client's long-term Ed25519 key pair. It signs the
+// ephemeral keys used during key exchange so peers can tell who they are
+// really talking to.
+type Identity struct {
+	privateKey ed25519.PrivateKey
+}
+
+func GenerateIdentity() (*Identity, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{privateKey: privateKey}, nil
+}
+
+// LoadOrCreateIdentity reads the identity stored at path, or generates a new
+// one and saves it there if the file does not exist yet.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	pemBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		identity, err := GenerateIdentity()
+		if err != nil {
+			return nil, err
+		}
+		return identity, identity.save(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no private key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return &Identity{privateKey: privateKey}, nil
+}
+
+func (id *Identity) save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.privateKey)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.privateKey.Public().(ed25519.PublicKey)
+}
+
+// A SignedKey ties a public key (usually an ephemeral X25519 key) to the
+// username and identity key of whoever generated it. Key may be empty, in
+// which case it just announces the identity key.
+type SignedKey struct {
+	Username    string `json:"username"`
+	IdentityKey []byte `json:"identityKey"`
+	Key         []byte `json:"key,omitempty"`
+	Signature   []byte `json:"signature"`
+}
+
+func signedKeyMessage(username string, key []byte) []byte {
+	message := make([]byte, 0, len(signedKeyContext)+len(username)+len(key)+8)
+	message = append(message, signedKeyContext...)
+	message = binary.BigEndian.AppendUint64(message, uint64(len(username)))
+	message = append(message, username...)
+	message = append(message, key...)
+	return message
+}
+
+func (id *Identity) Sign(username string, key []byte) SignedKey {
+	return SignedKey{
+		Username:    username,
+		IdentityKey: id.PublicKey(),
+		Key:         key,
+		Signature:   ed25519.Sign(id.privateKey, signedKeyMessage(username, key)),
+	}
+}
+
+// Verify checks that the signature was made by IdentityKey. It says nothing
+// about whether IdentityKey really belongs to Username; that is what safety
+// numbers are for.
+func (sk *SignedKey) Verify() error {
+	if len(sk.IdentityKey) != ed25519.PublicKeySize {
+		return errors.New("invalid identity key")
+	}
+	if !ed25519.Verify(sk.IdentityKey, signedKeyMessage(sk.Username, sk.Key), sk.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Fingerprint is a short human readable form of an identity key
+func Fingerprint(identityKey []byte) string {
+	sum := sha256.Sum256(identityKey)
+	encoded := hex.EncodeToString(sum[:16])
+
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// SafetyNumber derives a 60 digit number from two users' identity keys. Both
+// users get the same number no matter who computes it, so they can compare it
+// out of band; if the server swapped either key, the numbers will differ.
+func SafetyNumber(usernameA string, identityKeyA []byte, usernameB string, identityKeyB []byte) string {
+	type party struct {
+		username string
+		key      []byte
+	}
+	parties := []party{{usernameA, identityKeyA}, {usernameB, identityKeyB}}
+	if usernameA > usernameB || (usernameA == usernameB && string(identityKeyA) > string(identityKeyB)) {
+		parties[0], parties[1] = parties[1], parties[0]
+	}
+
+	hash := sha512.New()
+	hash.Write([]byte(safetyNumberContext))
+	for _, p := range parties {
+		hash.Write(binary.BigEndian.AppendUint64(nil, uint64(len(p.username))))
+		hash.Write([]byte(p.username))
+		hash.Write(p.key)
+	}
+	sum := hash.Sum(nil)
+
+	// Twelve groups of five digits, each taken from five bytes of the hash
+	groups := make([]string, 12)
+	for i := range groups {
+		chunk := sum[i*5 : i*5+5]
+		value := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 | uint64(chunk[4])
+		groups[i] = fmt.Sprintf("%05d", value%100000)
+	}
+	return strings.Join(groups, " ")
+}
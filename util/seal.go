@@ -0,0 +1,86 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Ciphertexts produced by Seal start with a version tag so that clients can
+// tell them apart from the legacy unauthenticated AES-CFB format, which is a
+// bare hex string.
+const (
+	SealVersion       = "v2"
+	sealVersionPrefix = SealVersion + ":"
+)
+
+var (
+	// The message was encrypted by an old client with the legacy format
+	ErrLegacyCiphertext = errors.New("ciphertext uses the legacy unauthenticated format")
+	// The ciphertext is tagged with a version this client does not know
+	ErrUnknownVersion = errors.New("ciphertext uses an unknown format version")
+	// Authentication failed: the ciphertext, the associated data or the key
+	// do not match what the sender used
+	ErrTampered = errors.New("message failed authentication and may have been tampered with")
+)
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts and authenticates plaintext with AES-GCM. additionalData is
+// authenticated but not encrypted, and must be passed unchanged to Open.
+func Seal(plaintext []byte, key []byte, additionalData []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, additionalData)
+
+	return sealVersionPrefix + hex.EncodeToString(sealed), nil
+}
+
+// Open reverses Seal. Any modification of the ciphertext or the associated
+// data makes it return ErrTampered.
+func Open(ciphertext string, key []byte, additionalData []byte) ([]byte, error) {
+	version, encoded, found := strings.Cut(ciphertext, ":")
+	if !found {
+		return nil, ErrLegacyCiphertext
+	}
+	if version != SealVersion {
+		return nil, ErrUnknownVersion
+	}
+
+	sealed, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrTampered
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrTampered
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+)
+
+// How far ahead of the last message we will ratchet to decrypt a message that
+// arrived out of order
+const maxSkippedKeys = 1000
+
+var (
+	ErrOldMessageKey = errors.New("message key already used or discarded")
+	ErrTooFarAhead   = errors.New("message is too far ahead in the sender's chain")
+)
+
+// A SenderChain is one member's hash ratchet. Every message gets its own key,
+// and the chain key is replaced after each step so that a captured chain key
+// only exposes messages from that point on.
+type SenderChain struct {
+	chainKey []byte
+	// Index of the message key chainKey will produce next
+	index uint64
+	// Keys for messages we skipped over but have not received yet
+	skipped map[uint64][]byte
+	mu      sync.Mutex
+}
+
+func NewSenderChain() (*SenderChain, error) {
+	chainKey := make([]byte, 32)
+	_, err := rand.Read(chainKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SenderChain{chainKey: chainKey}, nil
+}
+
+// RestoreSenderChain rebuilds a peer's chain from the state they announced
+func RestoreSenderChain(index uint64, chainKey []byte) (*SenderChain, error) {
+	if len(chainKey) != 32 {
+		return nil, errors.New("invalid chain key length")
+	}
+	return &SenderChain{chainKey: chainKey, index: index}, nil
+}
+
+func hmacStep(key []byte, label byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{label})
+	return mac.Sum(nil)
+}
+
+// step must be called with c.mu held
+func (c *SenderChain) step() []byte {
+	messageKey := hmacStep(c.chainKey, 0x01)
+	c.chainKey = hmacStep(c.chainKey, 0x02)
+	c.index++
+	return messageKey
+}
+
+// State returns the chain's current position, so it can be announced to
+// other members. They will be able to read our messages from index onwards.
+func (c *SenderChain) State() (uint64, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index, append([]byte(nil), c.chainKey...)
+}
+
+// Next returns the key for the next message we send, and its index
+func (c *SenderChain) Next() (uint64, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	index := c.index
+	return index, c.step()
+}
+
+// MessageKey returns the key for a received message without using it up, so
+// that a forged message cannot burn the key of the real one. Once the message
+// has been opened with it, Commit must be called.
+func (c *SenderChain) MessageKey(index uint64) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if index < c.index {
+		messageKey, ok := c.skipped[index]
+		if !ok {
+			return nil, ErrOldMessageKey
+		}
+		return messageKey, nil
+	}
+	if index-c.index > maxSkippedKeys {
+		return nil, ErrTooFarAhead
+	}
+
+	chainKey := c.chainKey
+	for i := c.index; i < index; i++ {
+		chainKey = hmacStep(chainKey, 0x02)
+	}
+	return hmacStep(chainKey, 0x01), nil
+}
+
+// Commit uses up the key for index after a message was opened with it. The
+// chain moves past it, keeping the keys it skips over for messages that have
+// not arrived yet.
+func (c *SenderChain) Commit(index uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if index < c.index {
+		delete(c.skipped, index)
+		return
+	}
+	if index-c.index > maxSkippedKeys {
+		return
+	}
+
+	for c.index < index {
+		if c.skipped == nil {
+			c.skipped = make(map[uint64][]byte)
+		}
+		skippedIndex := c.index
+		c.skipped[skippedIndex] = c.step()
+	}
+	c.step()
+	// Keep the skipped keys from growing without bound if messages never
+	// arrive
+	for skippedIndex := range c.skipped {
+		if index-skippedIndex > maxSkippedKeys {
+			delete(c.skipped, skippedIndex)
+		}
+	}
+}
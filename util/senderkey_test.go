@@ -0,0 +1,105 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMessageKeyIsOnlyUsedUpByCommit(t *testing.T) {
+	sender, err := NewSenderChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, chainKey := sender.State()
+	receiver, err := RestoreSenderChain(index, chainKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent [][]byte
+	for range 4 {
+		_, messageKey := sender.Next()
+		sent = append(sent, messageKey)
+	}
+
+	// A forged message for index 2 that fails to open leaves the key alone
+	forged, err := receiver.MessageKey(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forged, sent[2]) {
+		t.Fatal("key for index 2 does not match the sender's")
+	}
+	genuine, err := receiver.MessageKey(2)
+	if err != nil {
+		t.Fatal("key for index 2 was used up without a commit:", err)
+	}
+	receiver.Commit(2)
+
+	_, err = receiver.MessageKey(2)
+	if !errors.Is(err, ErrOldMessageKey) {
+		t.Fatalf("key for index 2 after commit: got %v, want %v", err, ErrOldMessageKey)
+	}
+	if !bytes.Equal(genuine, sent[2]) {
+		t.Fatal("key for index 2 does not match the sender's")
+	}
+
+	// The keys skipped over are kept until their messages arrive
+	for _, i := range []uint64{0, 1, 3} {
+		messageKey, err := receiver.MessageKey(i)
+		if err != nil {
+			t.Fatalf("key for index %d: %v", i, err)
+		}
+		if !bytes.Equal(messageKey, sent[i]) {
+			t.Fatalf("key for index %d does not match the sender's", i)
+		}
+		receiver.Commit(i)
+	}
+	_, err = receiver.MessageKey(1)
+	if !errors.Is(err, ErrOldMessageKey) {
+		t.Fatalf("key for index 1 after commit: got %v, want %v", err, ErrOldMessageKey)
+	}
+}
+
+func TestMessageKeyTooFarAhead(t *testing.T) {
+	chain, err := NewSenderChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = chain.MessageKey(maxSkippedKeys + 1)
+	if !errors.Is(err, ErrTooFarAhead) {
+		t.Fatalf("got %v, want %v", err, ErrTooFarAhead)
+	}
+}
+
+func TestAnnouncedChainOnlyOpensLaterMessages(t *testing.T) {
+	sender, err := NewSenderChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		sender.Next()
+	}
+
+	// Someone who gets the chain at index 3 cannot go back to 0, 1 or 2
+	index, chainKey := sender.State()
+	receiver, err := RestoreSenderChain(index, chainKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range index {
+		_, err = receiver.MessageKey(i)
+		if !errors.Is(err, ErrOldMessageKey) {
+			t.Fatalf("key for index %d: got %v, want %v", i, err, ErrOldMessageKey)
+		}
+	}
+
+	_, sent := sender.Next()
+	messageKey, err := receiver.MessageKey(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(messageKey, sent) {
+		t.Fatalf("key for index %d does not match the sender's", index)
+	}
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Pins are written the way curl's --pinnedpubkey takes them
+const pinPrefix = "sha256//"
+
+// CertificatePin is the SHA-256 hash of a certificate's public key. Pinning
+// the key rather than the certificate keeps the pin valid when the
+// certificate is renewed with the same key.
+func CertificatePin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// ParsePin checks a pin given by the user. The "sha256//" prefix is optional.
+func ParsePin(pin string) (string, error) {
+	hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+	if err != nil || len(hash) != sha256.Size {
+		return "", errors.New("pin must be a base64 SHA-256 hash, like " + pinPrefix + "AAAA...=")
+	}
+	return pinPrefix + base64.StdEncoding.EncodeToString(hash), nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Error reading CA bundle: " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("Error reading CA bundle: no certificates in " + path)
+	}
+	return pool, nil
+}
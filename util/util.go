@@ -1,27 +1,31 @@
 package util
 
-// https://www.codingexplorations.com/blog/understanding-encryption-in-go-a-developers-guide
-// https://eminmuhammadi.com/articles/diffiehellman-key-exchange-example-in-golang
+// https://pkg.go.dev/crypto/ecdh
+// https://datatracker.ietf.org/doc/html/rfc5869
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
 	"crypto/rand"
-	"encoding/hex"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"math/big"
-	"net/url"
-
-	"github.com/gorilla/websocket"
+	"sync"
 )
 
-var (
-	P, G, privateKey, publicKey *big.Int
-	roomKey                     []byte
-)
+// Info string for HKDF, so keys derived for wrapping the room key can never
+// collide with keys derived for anything else
+const roomKeyWrapInfo = "websocket-chat room key wrap v1"
+
+// Keys holds the room keys one client shares with the rest of the room. The
+// key from the previous epoch is kept so messages sent just before a rotation
+// can still be read.
+type Keys struct {
+	roomKeys map[uint64][]byte
+	epoch    uint64
+	mu       sync.RWMutex
+}
 
 // Clear the current line in the terminal after pressing return
 func ClearLine() {
@@ -32,195 +36,183 @@ func ClearTerminal() {
 	fmt.Print("\033[H\033[2J")
 }
 
-func GenerateKeys() {
-	P = GeneratePrime()
-	G = big.NewInt(2)
-	GeneratePrivateKey()
-	CalculatePublicKey(G)
-	checkRoomKey()
-}
-
-func checkRoomKey() {
-	if roomKey == nil {
-		roomKey = make([]byte, 32)
-		_, err := rand.Read(roomKey)
-		if err != nil {
-			log.Println("room key:", err)
-		}
+// GenerateKeys makes a fresh room key for epoch and starts using it. Only the
+// key hub does this.
+func (k *Keys) GenerateKeys(epoch uint64) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.roomKeys[epoch] != nil {
+		return nil
 	}
-}
 
-func Encrypt(plaintext []byte, key []byte) (string, error) {
-	// key, _ := hex.DecodeString(keyString) // Convert the key to bytes
-	// key := []byte(keyString)
-	block, err := aes.NewCipher(key)
+	roomKey := make([]byte, 32)
+	_, err := rand.Read(roomKey)
 	if err != nil {
-		return "", err
+		return errors.New("Error generating room key: " + err.Error())
 	}
-
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize] // Initialization vector
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		return "", err
-	}
-
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
-
-	// Return the encoded hex string
-	return hex.EncodeToString(ciphertext), nil
+	k.setRoomKey(epoch, roomKey)
+	return nil
 }
 
-func Decrypt(ciphertext string, key []byte) ([]byte, error) {
-	// key, _ := hex.DecodeString(keyString)
-	ciphertextBytes, _ := hex.DecodeString(ciphertext)
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+// setRoomKey must be called with k.mu held
+func (k *Keys) setRoomKey(epoch uint64, roomKey []byte) {
+	if k.roomKeys == nil {
+		k.roomKeys = make(map[uint64][]byte)
 	}
-
-	if len(ciphertextBytes) < aes.BlockSize {
-		return nil, errors.New("ciphertext too short")
+	k.roomKeys[epoch] = roomKey
+	if epoch >= k.epoch {
+		k.epoch = epoch
 	}
 
-	iv := ciphertextBytes[:aes.BlockSize]
-	ciphertextBytes = ciphertextBytes[aes.BlockSize:]
-
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(ciphertextBytes, ciphertextBytes)
-
-	return ciphertextBytes, nil
-}
-
-// Needs to generate a modulus used by both server and client
-func GeneratePrime() *big.Int {
-	prime, _ := rand.Prime(rand.Reader, 256)
-	return prime
+	// Only the previous epoch is needed, for messages that were in flight
+	// during the rotation. Forgetting the rest keeps a captured client from
+	// exposing older traffic.
+	for oldEpoch := range k.roomKeys {
+		if oldEpoch+1 < k.epoch {
+			delete(k.roomKeys, oldEpoch)
+		}
+	}
 }
 
-// Both parties generate private keys
-func GeneratePrivateKey() {
-	privateKey, _ = rand.Int(rand.Reader, P)
+// The wrapped room key is prefixed with its epoch
+func encodeRoomKey(epoch uint64, roomKey []byte) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, epoch), roomKey...)
 }
 
-// Both parties calculate their own public keys
-func CalculatePublicKey(base *big.Int) {
-	publicKey = new(big.Int).Exp(base, privateKey, P)
+func decodeRoomKey(encoded []byte) (uint64, []byte, error) {
+	if len(encoded) != 8+32 {
+		return 0, nil, errors.New("invalid room key length")
+	}
+	return binary.BigEndian.Uint64(encoded[:8]), encoded[8:], nil
 }
 
-// Parties exchange public keys and use them to calculate shared secret
-func CalculateSharedSecret(publicKeyRemote *big.Int) *big.Int {
-	sharedSecret := new(big.Int).Exp(publicKeyRemote, privateKey, P)
-	return sharedSecret
+// Both parties generate a fresh X25519 key pair for every exchange
+func generateEphemeralKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
 }
 
-func DoKeyExchange(conn *websocket.Conn) error {
-	// Receive P, G, key hub public key from server
-	_, Pbytes, err := conn.ReadMessage()
-	if err != nil {
-		newError := errors.New("Error receiving P from server:" + err.Error())
-		return newError
-	}
-	P = new(big.Int).SetBytes(Pbytes)
-
-	_, Gbytes, err := conn.ReadMessage()
+// deriveWrappingKey turns the X25519 shared secret into the AES-256 key that
+// protects the room key in transit. Both public keys are mixed in so the key
+// is bound to this particular exchange.
+func deriveWrappingKey(privateKey *ecdh.PrivateKey, remotePublicKeyBytes []byte, keyHubPublicKey, clientPublicKey []byte) ([]byte, error) {
+	remotePublicKey, err := ecdh.X25519().NewPublicKey(remotePublicKeyBytes)
 	if err != nil {
-		newError := errors.New("Error receiving G from server:" + err.Error())
-		return newError
+		return nil, errors.New("invalid public key: " + err.Error())
 	}
-	G = new(big.Int).SetBytes(Gbytes)
 
-	_, keyHubPubKeyBytes, err := conn.ReadMessage()
+	sharedSecret, err := privateKey.ECDH(remotePublicKey)
 	if err != nil {
-		newError := errors.New("Error receiving key hub's public key:" + err.Error())
-		return newError
+		return nil, err
 	}
-	keyHubPubKey := new(big.Int).SetBytes(keyHubPubKeyBytes)
 
-	// Calculate private key
-	GeneratePrivateKey()
+	info := make([]byte, 0, len(roomKeyWrapInfo)+len(keyHubPublicKey)+len(clientPublicKey))
+	info = append(info, roomKeyWrapInfo...)
+	info = append(info, keyHubPublicKey...)
+	info = append(info, clientPublicKey...)
+	return hkdf.Key(sha256.New, sharedSecret, nil, string(info), 32)
+}
 
-	// Calculate public key
-	CalculatePublicKey(G)
+// A KeyExchange is one side of a room key handoff between the key hub and a
+// member. The frames are carried by the chat connection, so each side keeps
+// one of these per exchange until the room key has been passed on.
+type KeyExchange struct {
+	privateKey *ecdh.PrivateKey
+	// Our ephemeral public key, as signed and sent to the other side
+	publicKey []byte
+	// The key hub's signed ephemeral key. Only set on the member's side.
+	keyHubKey *SignedKey
+}
 
-	// Send public key to server
-	err = conn.WriteMessage(websocket.BinaryMessage, publicKey.Bytes())
+// OfferKey starts the key hub's side of an exchange. The returned signed key
+// is sent to the member.
+func OfferKey(identity *Identity, username string) (*KeyExchange, SignedKey, error) {
+	privateKey, err := generateEphemeralKey()
 	if err != nil {
-		newError := errors.New("Error sending public key to server:" + err.Error())
-		return newError
+		return nil, SignedKey{}, errors.New("Error generating key pair:" + err.Error())
 	}
-	// Calculate PSK with server pub key
-	psk := CalculateSharedSecret(keyHubPubKey)
+	publicKeyBytes := privateKey.PublicKey().Bytes()
+	exchange := &KeyExchange{privateKey: privateKey, publicKey: publicKeyBytes}
+	return exchange, identity.Sign(username, publicKeyBytes), nil
+}
 
-	// Receive room key from server
-	_, encryptedRoomKeyBytes, err := conn.ReadMessage()
+// AcceptKey runs the member's side of an exchange once the key hub's offer
+// arrives. The returned signed key is sent back to the key hub.
+func AcceptKey(identity *Identity, username string, keyHubKey *SignedKey) (*KeyExchange, SignedKey, error) {
+	err := keyHubKey.Verify()
 	if err != nil {
-		newError := errors.New("Error receiving room key from server:" + err.Error())
-		return newError
+		return nil, SignedKey{}, errors.New("Error verifying key hub's public key:" + err.Error())
 	}
 
-	roomKey, err = Decrypt(string(encryptedRoomKeyBytes), psk.Bytes())
+	privateKey, err := generateEphemeralKey()
 	if err != nil {
-		newError := errors.New("Error decrypting room key:" + err.Error())
-		return newError
+		return nil, SignedKey{}, errors.New("Error generating key pair:" + err.Error())
 	}
-	return nil
+	publicKeyBytes := privateKey.PublicKey().Bytes()
+	exchange := &KeyExchange{privateKey: privateKey, publicKey: publicKeyBytes, keyHubKey: keyHubKey}
+	return exchange, identity.Sign(username, publicKeyBytes), nil
 }
 
-func ShareKeys(hostName *string, hostPort *int) error {
-	u := url.URL{Scheme: "ws", Host: fmt.Sprintf("%s:%d", *hostName, *hostPort), Path: "/key-exchange"}
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatal(err)
-		return err
+// WrapRoomKey finishes the key hub's side of an exchange by encrypting the
+// current room key for the member whose signed key is given
+func (k *Keys) WrapRoomKey(exchange *KeyExchange, clientKey *SignedKey) (string, error) {
+	epoch, roomKey := k.GetRoomKey()
+	if roomKey == nil {
+		return "", errors.New("no room key to share")
 	}
-	defer conn.Close()
 
-	// Send P, G, public key to server
-	err = conn.WriteMessage(websocket.BinaryMessage, P.Bytes())
+	err := clientKey.Verify()
 	if err != nil {
-		newError := errors.New("Error sending P to server:" + err.Error())
-		return newError
+		return "", errors.New("Error verifying client's public key:" + err.Error())
 	}
-
-	err = conn.WriteMessage(websocket.BinaryMessage, G.Bytes())
+	wrappingKey, err := deriveWrappingKey(exchange.privateKey, clientKey.Key, exchange.publicKey, clientKey.Key)
 	if err != nil {
-		newError := errors.New("Error sending G to server:" + err.Error())
-		return newError
+		return "", errors.New("Error deriving wrapping key:" + err.Error())
 	}
 
-	err = conn.WriteMessage(websocket.BinaryMessage, publicKey.Bytes())
+	encryptedRoomKey, err := Seal(encodeRoomKey(epoch, roomKey), wrappingKey, []byte(roomKeyWrapInfo))
 	if err != nil {
-		newError := errors.New("Error sending public key to server:" + err.Error())
-		return newError
+		return "", errors.New("Error encrypting room key:" + err.Error())
 	}
+	return encryptedRoomKey, nil
+}
 
-	// Receive other client's public key
-	_, clientPubKeyBytes, err := conn.ReadMessage()
+// UnwrapRoomKey finishes the member's side of an exchange and stores the
+// room key it received. It returns the key's epoch.
+func (k *Keys) UnwrapRoomKey(exchange *KeyExchange, encryptedRoomKey string) (uint64, error) {
+	if exchange.keyHubKey == nil {
+		return 0, errors.New("no key offer for this exchange")
+	}
+	wrappingKey, err := deriveWrappingKey(exchange.privateKey, exchange.keyHubKey.Key, exchange.keyHubKey.Key, exchange.publicKey)
 	if err != nil {
-		newError := errors.New("Error receiving client's public key:" + err.Error())
-		return newError
+		return 0, errors.New("Error deriving wrapping key:" + err.Error())
 	}
-	clientPubKey := new(big.Int).SetBytes(clientPubKeyBytes)
 
-	// Calculate PSK
-	psk := CalculateSharedSecret(clientPubKey)
-
-	// Send encrypted room key
-	encryptedRoomKey, err := Encrypt(roomKey, psk.Bytes())
+	encodedRoomKey, err := Open(encryptedRoomKey, wrappingKey, []byte(roomKeyWrapInfo))
 	if err != nil {
-		newError := errors.New("Error encrypting room key:" + err.Error())
-		return newError
+		return 0, errors.New("Error decrypting room key:" + err.Error())
 	}
-	err = conn.WriteMessage(websocket.BinaryMessage, []byte(encryptedRoomKey))
+	epoch, roomKey, err := decodeRoomKey(encodedRoomKey)
 	if err != nil {
-		newError := errors.New("Error sending room key to server:" + err.Error())
-		return newError
+		return 0, errors.New("Error decrypting room key:" + err.Error())
 	}
-	return nil
+	k.mu.Lock()
+	k.setRoomKey(epoch, roomKey)
+	k.mu.Unlock()
+	return epoch, nil
 }
 
-func GetRoomKey() []byte {
-	return roomKey
-}
\ No newline at end of file
+// GetRoomKey returns the newest room key and its epoch. New messages should
+// be encrypted with it.
+func (k *Keys) GetRoomKey() (uint64, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.epoch, k.roomKeys[k.epoch]
+}
+
+// GetRoomKeyForEpoch returns the room key of an earlier or current epoch, or
+// nil if we never had it
+func (k *Keys) GetRoomKeyForEpoch(epoch uint64) []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.roomKeys[epoch]
+}